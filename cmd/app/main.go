@@ -16,6 +16,7 @@ import (
 	redisProvider "github.com/Puneet-Vishnoi/Coupon-System/cache/redis/providers"
 	"github.com/Puneet-Vishnoi/Coupon-System/db/postgres"
 	providers "github.com/Puneet-Vishnoi/Coupon-System/db/postgres/providers"
+	"github.com/Puneet-Vishnoi/Coupon-System/models"
 	"github.com/Puneet-Vishnoi/Coupon-System/repository"
 	"github.com/Puneet-Vishnoi/Coupon-System/routes"
 	couponService "github.com/Puneet-Vishnoi/Coupon-System/service"
@@ -51,6 +52,36 @@ func main() {
 	couponRepo := repository.NewCouponRepository(dbHelper)
 	couponSrv := couponService.NewCouponService(couponRepo, redisHelper)
 
+	// 4.1 Exchange rates for cross-currency coupons, e.g. EXCHANGE_RATES="USD=83.10,EUR=90.25"
+	rates, err := couponService.ParseExchangeRates(models.DefaultCurrency, os.Getenv("EXCHANGE_RATES"))
+	if err != nil {
+		log.Fatalf("Failed to load exchange rates: %v", err)
+	}
+	couponSrv.Rates = rates
+
+	// 4.2 How far client timestamps may drift from server time, e.g. CLOCK_SKEW_TOLERANCE=2m
+	if skew := os.Getenv("CLOCK_SKEW_TOLERANCE"); skew != "" {
+		d, err := time.ParseDuration(skew)
+		if err != nil {
+			log.Fatalf("Invalid CLOCK_SKEW_TOLERANCE: %v", err)
+		}
+		couponSrv.MaxClockSkew = d
+	}
+
+	// 4.3 Combined cap for stacked coupons as a percentage of the order, e.g. MAX_COMBINED_DISCOUNT_PERCENT=40
+	if percent := os.Getenv("MAX_COMBINED_DISCOUNT_PERCENT"); percent != "" {
+		p, err := models.ParseMoney(percent)
+		if err != nil || p < 0 || p > 100_00 {
+			log.Fatalf("Invalid MAX_COMBINED_DISCOUNT_PERCENT: %q", percent)
+		}
+		couponSrv.MaxCombinedDiscountPercent = p
+	}
+
+	// 4.4 Expire reservations that were never confirmed or released
+	sweepCtx, stopSweeper := context.WithCancel(context.Background())
+	defer stopSweeper()
+	couponSrv.StartReservationSweeper(sweepCtx, time.Minute)
+
 	// 5. Gin Router & Handlers
 	router := gin.Default()
 	routes.RegisterRoutes(router, couponSrv)
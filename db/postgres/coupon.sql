@@ -19,14 +19,14 @@ DO $$
 BEGIN
     IF EXISTS (SELECT 1 FROM pg_type WHERE typname = 'discount_type') THEN
         ALTER TYPE discount_type RENAME TO discount_type_old;
-        CREATE TYPE discount_type AS ENUM ('flat', 'percentage');
+        CREATE TYPE discount_type AS ENUM ('flat', 'percentage', 'buy_x_get_y', 'free_delivery');
         ALTER TABLE coupons
             ALTER COLUMN discount_type DROP DEFAULT,
             ALTER COLUMN discount_type TYPE discount_type USING discount_type::text::discount_type,
             ALTER COLUMN discount_type SET DEFAULT 'flat'::discount_type;
         DROP TYPE discount_type_old;
     ELSE
-        CREATE TYPE discount_type AS ENUM ('flat', 'percentage');
+        CREATE TYPE discount_type AS ENUM ('flat', 'percentage', 'buy_x_get_y', 'free_delivery');
     END IF;
 END $$;
 
@@ -46,6 +46,54 @@ BEGIN
     END IF;
 END $$;
 
+-- Recreate coupon_status ENUM
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_type WHERE typname = 'coupon_status') THEN
+        ALTER TYPE coupon_status RENAME TO coupon_status_old;
+        CREATE TYPE coupon_status AS ENUM ('draft', 'scheduled', 'active', 'paused', 'archived');
+        ALTER TABLE coupons
+            ALTER COLUMN status DROP DEFAULT,
+            ALTER COLUMN status TYPE coupon_status USING status::text::coupon_status,
+            ALTER COLUMN status SET DEFAULT 'active'::coupon_status;
+        DROP TYPE coupon_status_old;
+    ELSE
+        CREATE TYPE coupon_status AS ENUM ('draft', 'scheduled', 'active', 'paused', 'archived');
+    END IF;
+END $$;
+
+-- Recreate usage_status ENUM
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_type WHERE typname = 'usage_status') THEN
+        ALTER TYPE usage_status RENAME TO usage_status_old;
+        CREATE TYPE usage_status AS ENUM ('reserved', 'confirmed', 'released', 'expired', 'reversed');
+        ALTER TABLE coupon_usages
+            ALTER COLUMN status DROP DEFAULT,
+            ALTER COLUMN status TYPE usage_status USING status::text::usage_status,
+            ALTER COLUMN status SET DEFAULT 'confirmed'::usage_status;
+        DROP TYPE usage_status_old;
+    ELSE
+        CREATE TYPE usage_status AS ENUM ('reserved', 'confirmed', 'released', 'expired', 'reversed');
+    END IF;
+END $$;
+
+-- Recreate rounding_mode ENUM
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_type WHERE typname = 'rounding_mode') THEN
+        ALTER TYPE rounding_mode RENAME TO rounding_mode_old;
+        CREATE TYPE rounding_mode AS ENUM ('half_up', 'floor', 'ceil');
+        ALTER TABLE coupons
+            ALTER COLUMN rounding_mode DROP DEFAULT,
+            ALTER COLUMN rounding_mode TYPE rounding_mode USING rounding_mode::text::rounding_mode,
+            ALTER COLUMN rounding_mode SET DEFAULT 'half_up'::rounding_mode;
+        DROP TYPE rounding_mode_old;
+    ELSE
+        CREATE TYPE rounding_mode AS ENUM ('half_up', 'floor', 'ceil');
+    END IF;
+END $$;
+
 -- Create coupons table
 CREATE TABLE IF NOT EXISTS coupons (
     coupon_code TEXT PRIMARY KEY,
@@ -53,21 +101,129 @@ CREATE TABLE IF NOT EXISTS coupons (
     usage_type usage_type NOT NULL DEFAULT 'single_use'::usage_type,
     applicable_medicine_ids JSONB NOT NULL DEFAULT '[]',
     applicable_categories JSONB NOT NULL DEFAULT '[]',
-    min_order_value DOUBLE PRECISION NOT NULL DEFAULT 0,
+    min_order_value NUMERIC(14,2) NOT NULL DEFAULT 0,
     valid_start TIMESTAMPTZ NOT NULL,
     valid_end TIMESTAMPTZ NOT NULL,
     terms_and_conditions TEXT NOT NULL DEFAULT '',
     discount_type discount_type NOT NULL DEFAULT 'flat'::discount_type,
-    discount_value DOUBLE PRECISION NOT NULL DEFAULT 0,
+    discount_value NUMERIC(14,2) NOT NULL DEFAULT 0,
     max_usage_per_user INTEGER NOT NULL DEFAULT 1,
     discount_target discount_target NOT NULL DEFAULT 'total_order_value'::discount_target,
-    max_discount_amount DOUBLE PRECISION NOT NULL DEFAULT 0
+    max_discount_amount NUMERIC(14,2) NOT NULL DEFAULT 0,
+    version INTEGER NOT NULL DEFAULT 1,
+    status coupon_status NOT NULL DEFAULT 'active'::coupon_status,
+    max_total_redemptions INTEGER NOT NULL DEFAULT 0,
+    max_total_discount_budget NUMERIC(14,2) NOT NULL DEFAULT 0,
+    min_eligible_units INTEGER NOT NULL DEFAULT 0,
+    buy_x_get_y JSONB,
+    tiers JSONB NOT NULL DEFAULT '[]',
+    applicable_delivery_types JSONB NOT NULL DEFAULT '[]',
+    rounding_mode rounding_mode NOT NULL DEFAULT 'half_up'::rounding_mode,
+    rounding_unit NUMERIC(14,2) NOT NULL DEFAULT 0.01,
+    currency CHAR(3) NOT NULL DEFAULT 'INR',
+    allow_cross_currency BOOLEAN NOT NULL DEFAULT FALSE,
+    excluded_medicine_ids JSONB NOT NULL DEFAULT '[]',
+    excluded_categories JSONB NOT NULL DEFAULT '[]',
+    schedule JSONB,
+    segment_rules JSONB,
+    stacking_group TEXT NOT NULL DEFAULT '',
+    exclusive BOOLEAN NOT NULL DEFAULT FALSE,
+    precedence INTEGER NOT NULL DEFAULT 0
 );
 
+-- Columns added after the initial release
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS status coupon_status NOT NULL DEFAULT 'active'::coupon_status;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS max_total_redemptions INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS max_total_discount_budget NUMERIC(14,2) NOT NULL DEFAULT 0;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS min_eligible_units INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS buy_x_get_y JSONB;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS tiers JSONB NOT NULL DEFAULT '[]';
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS applicable_delivery_types JSONB NOT NULL DEFAULT '[]';
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS rounding_mode rounding_mode NOT NULL DEFAULT 'half_up'::rounding_mode;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS rounding_unit NUMERIC(14,2) NOT NULL DEFAULT 0.01;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'INR';
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS allow_cross_currency BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS excluded_medicine_ids JSONB NOT NULL DEFAULT '[]';
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS excluded_categories JSONB NOT NULL DEFAULT '[]';
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS schedule JSONB;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS segment_rules JSONB;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS stacking_group TEXT NOT NULL DEFAULT '';
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS exclusive BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE coupons ADD COLUMN IF NOT EXISTS precedence INTEGER NOT NULL DEFAULT 0;
+
+-- Money used to be DOUBLE PRECISION; NUMERIC keeps amounts exact to the paisa
+ALTER TABLE coupons
+    ALTER COLUMN min_order_value TYPE NUMERIC(14,2),
+    ALTER COLUMN discount_value TYPE NUMERIC(14,2),
+    ALTER COLUMN max_discount_amount TYPE NUMERIC(14,2),
+    ALTER COLUMN max_total_discount_budget TYPE NUMERIC(14,2);
+
 -- Create coupon_usages table
 CREATE TABLE IF NOT EXISTS coupon_usages (
     id SERIAL PRIMARY KEY,
     user_id TEXT NOT NULL,
     coupon_code TEXT NOT NULL REFERENCES coupons(coupon_code) ON DELETE CASCADE,
-    used_at TIMESTAMPTZ DEFAULT NOW()
+    used_at TIMESTAMPTZ DEFAULT NOW(),
+    status usage_status NOT NULL DEFAULT 'confirmed'::usage_status,
+    order_id TEXT,
+    reserved_until TIMESTAMPTZ,
+    discount_amount NUMERIC(14,2) NOT NULL DEFAULT 0,
+    client_timestamp TIMESTAMPTZ,
+    clock_skew BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+ALTER TABLE coupon_usages ADD COLUMN IF NOT EXISTS status usage_status NOT NULL DEFAULT 'confirmed'::usage_status;
+ALTER TABLE coupon_usages ADD COLUMN IF NOT EXISTS order_id TEXT;
+ALTER TABLE coupon_usages ADD COLUMN IF NOT EXISTS reserved_until TIMESTAMPTZ;
+ALTER TABLE coupon_usages ADD COLUMN IF NOT EXISTS discount_amount NUMERIC(14,2) NOT NULL DEFAULT 0;
+ALTER TABLE coupon_usages ALTER COLUMN discount_amount TYPE NUMERIC(14,2);
+ALTER TABLE coupon_usages ADD COLUMN IF NOT EXISTS client_timestamp TIMESTAMPTZ;
+ALTER TABLE coupon_usages ADD COLUMN IF NOT EXISTS clock_skew BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Lets redemptions find the coupons already applied to the same order
+CREATE INDEX IF NOT EXISTS idx_coupon_usages_order_id
+    ON coupon_usages (order_id);
+
+-- Lets the reservation sweeper find stale holds without scanning every usage
+CREATE INDEX IF NOT EXISTS idx_coupon_usages_status_reserved_until
+    ON coupon_usages (status, reserved_until);
+
+-- Audit trail for redemptions that were undone after an order was cancelled or refunded
+CREATE TABLE IF NOT EXISTS coupon_usage_reversals (
+    id SERIAL PRIMARY KEY,
+    usage_id INTEGER NOT NULL REFERENCES coupon_usages(id) ON DELETE CASCADE,
+    order_id TEXT,
+    reason TEXT NOT NULL,
+    reversed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Outcomes of redemptions made with an Idempotency-Key, replayed on retries
+CREATE TABLE IF NOT EXISTS coupon_idempotency_keys (
+    idempotency_key TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    coupon_code TEXT NOT NULL REFERENCES coupons(coupon_code) ON DELETE CASCADE,
+    operation TEXT NOT NULL DEFAULT 'validate',
+    response JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+ALTER TABLE coupon_idempotency_keys ADD COLUMN IF NOT EXISTS operation TEXT NOT NULL DEFAULT 'validate';
+
+-- Outcomes of stacked redemptions made with an Idempotency-Key. The codes are
+-- kept as requested, so unknown codes are allowed and there is no foreign key.
+CREATE TABLE IF NOT EXISTS coupon_stack_idempotency_keys (
+    idempotency_key TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    coupon_codes JSONB NOT NULL,
+    response JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Customer facts used by coupon segment rules, maintained by the order pipeline
+CREATE TABLE IF NOT EXISTS user_profiles (
+    user_id TEXT PRIMARY KEY,
+    order_count INTEGER NOT NULL DEFAULT 0,
+    last_order_at TIMESTAMPTZ,
+    segments JSONB NOT NULL DEFAULT '[]',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
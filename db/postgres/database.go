@@ -87,7 +87,7 @@ func (db *Db) InitSchema(schema string) error {
 
 func (db *Db) ClearTestData() error {
 	_, err := db.PostgresClient.Exec(`
-		TRUNCATE TABLE coupons, coupon_usages RESTART IDENTITY CASCADE;
+		TRUNCATE TABLE coupons, coupon_usages, coupon_stack_idempotency_keys, user_profiles RESTART IDENTITY CASCADE;
 	`)
 	return err
 }
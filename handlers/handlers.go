@@ -1,9 +1,10 @@
 package handlers
 
 import (
+	"errors"
 	"log"
 	"net/http"
-	"time"
+	"strconv"
 
 	"github.com/Puneet-Vishnoi/Coupon-System/models"
 	"github.com/Puneet-Vishnoi/Coupon-System/service"
@@ -32,77 +33,475 @@ func formatValidationError(err error) map[string]string {
 	return errors
 }
 
+// Codes for requests turned away before they reach the service. Domain
+// failures carry their own codes, see service.Error.
+const (
+	codeInvalidRequest   = "INVALID_REQUEST"
+	codeValidationFailed = "VALIDATION_FAILED"
+	codeInternal         = "INTERNAL_ERROR"
+)
+
+// errorStatus maps errors returned by the service onto HTTP status codes.
+// Anything that is not a domain error is an internal failure.
+func errorStatus(err error) int {
+	var domainErr *service.Error
+	if !errors.As(err, &domainErr) {
+		return http.StatusInternalServerError
+	}
+	switch domainErr.Kind {
+	case service.KindInvalid:
+		return http.StatusBadRequest
+	case service.KindNotFound:
+		return http.StatusNotFound
+	case service.KindConflict:
+		return http.StatusConflict
+	case service.KindRejected:
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// respondError writes a service error in the standard envelope. Internal
+// failures are logged and hidden behind a generic message.
+func respondError(c *gin.Context, err error) {
+	status := errorStatus(err)
+	var domainErr *service.Error
+	if status == http.StatusInternalServerError || !errors.As(err, &domainErr) {
+		log.Printf("%s %s: %v", c.Request.Method, c.Request.URL.Path, err)
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{Error: models.ErrorBody{Code: codeInternal, Message: "internal server error"}})
+		return
+	}
+	c.JSON(status, models.ErrorResponse{Error: models.ErrorBody{Code: domainErr.Code, Message: err.Error()}})
+}
+
+// respondBadRequest writes a 400 for a request that could not be read.
+func respondBadRequest(c *gin.Context, message string) {
+	c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: models.ErrorBody{Code: codeInvalidRequest, Message: message}})
+}
+
+// respondValidation writes a 400 listing the fields that failed validation.
+func respondValidation(c *gin.Context, details map[string]string) {
+	c.JSON(http.StatusBadRequest, models.ErrorResponse{Error: models.ErrorBody{
+		Code:    codeValidationFailed,
+		Message: "request failed validation",
+		Details: details,
+	}})
+}
+
 // POST /coupons
 func (h *CouponHandler) CreateCoupon(c *gin.Context) {
 	var req models.Coupon
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		respondBadRequest(c, "Invalid request body")
 		return
 	}
 
 	if err := h.Validator.Struct(req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"validation_errors": formatValidationError(err)})
+		respondValidation(c, formatValidationError(err))
 		return
 	}
 
 	if err := h.Service.CreateCoupon(c.Request.Context(), &req); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusCreated, gin.H{"message": "Coupon created successfully"})
 }
 
+// GET /coupons/:code
+func (h *CouponHandler) GetCoupon(c *gin.Context) {
+	coupon, err := h.Service.GetCoupon(c.Request.Context(), c.Param("code"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, coupon)
+}
+
+// GET /coupons
+func (h *CouponHandler) ListCoupons(c *gin.Context) {
+	var req models.ListCouponsRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		respondBadRequest(c, "Invalid query parameters")
+		return
+	}
+
+	if err := h.Validator.Struct(req); err != nil {
+		respondValidation(c, formatValidationError(err))
+		return
+	}
+
+	resp, err := h.Service.ListCoupons(c.Request.Context(), req)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// PUT /coupons/:code
+func (h *CouponHandler) UpdateCoupon(c *gin.Context) {
+	var req models.Coupon
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBadRequest(c, "Invalid request body")
+		return
+	}
+
+	code := c.Param("code")
+	if req.CouponCode == "" {
+		req.CouponCode = code
+	}
+	if req.CouponCode != code {
+		respondBadRequest(c, "coupon_code does not match the URL")
+		return
+	}
+	if req.Version <= 0 {
+		respondValidation(c, map[string]string{"Version": "failed on tag 'required'"})
+		return
+	}
+
+	if err := h.Validator.Struct(req); err != nil {
+		respondValidation(c, formatValidationError(err))
+		return
+	}
+
+	if err := h.Service.UpdateCoupon(c.Request.Context(), &req); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, req)
+}
+
+// PATCH /coupons/:code
+func (h *CouponHandler) PatchCoupon(c *gin.Context) {
+	var patch models.CouponPatch
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		respondBadRequest(c, "Invalid request body")
+		return
+	}
+
+	if err := h.Validator.Struct(patch); err != nil {
+		respondValidation(c, formatValidationError(err))
+		return
+	}
+
+	coupon, err := h.Service.GetCoupon(c.Request.Context(), c.Param("code"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	// The merged coupon must still satisfy the same rules as a new one.
+	patch.ApplyTo(&coupon)
+	if err := h.Validator.Struct(coupon); err != nil {
+		respondValidation(c, formatValidationError(err))
+		return
+	}
+
+	if err := h.Service.UpdateCoupon(c.Request.Context(), &coupon); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, coupon)
+}
+
+// POST /coupons/:code/status
+func (h *CouponHandler) SetCouponStatus(c *gin.Context) {
+	var req models.CouponStatusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBadRequest(c, "Invalid request body")
+		return
+	}
+
+	if err := h.Validator.Struct(req); err != nil {
+		respondValidation(c, formatValidationError(err))
+		return
+	}
+
+	h.transitionCoupon(c, req.Status)
+}
+
+// POST /coupons/:code/pause
+func (h *CouponHandler) PauseCoupon(c *gin.Context) {
+	h.transitionCoupon(c, models.CouponStatusPaused)
+}
+
+// POST /coupons/:code/resume
+func (h *CouponHandler) ResumeCoupon(c *gin.Context) {
+	h.transitionCoupon(c, models.CouponStatusActive)
+}
+
+// POST /coupons/:code/archive
+func (h *CouponHandler) ArchiveCoupon(c *gin.Context) {
+	h.transitionCoupon(c, models.CouponStatusArchived)
+}
+
+func (h *CouponHandler) transitionCoupon(c *gin.Context, to models.CouponStatus) {
+	coupon, err := h.Service.TransitionCoupon(c.Request.Context(), c.Param("code"), to)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, coupon)
+}
+
 // POST /coupons/applicable
 func (h *CouponHandler) GetApplicableCoupons(c *gin.Context) {
 	var req models.ApplicableCouponsRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		log.Println(err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		respondBadRequest(c, "Invalid request body")
 		return
 	}
 
-	if req.Timestamp.IsZero() {
-		req.Timestamp = time.Now()
+	if err := h.Validator.Struct(req); err != nil {
+		log.Println(err)
+		respondValidation(c, formatValidationError(err))
+		return
+	}
+
+	resp, err := h.Service.GetApplicableCoupons(c.Request.Context(), req)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// POST /coupons/best
+func (h *CouponHandler) BestCoupons(c *gin.Context) {
+	var req models.ApplicableCouponsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBadRequest(c, "Invalid request body")
+		return
 	}
 
 	if err := h.Validator.Struct(req); err != nil {
-		log.Println(err)
-		c.JSON(http.StatusBadRequest, gin.H{"validation_errors": formatValidationError(err)})
+		respondValidation(c, formatValidationError(err))
 		return
 	}
 
-	coupons, err := h.Service.GetApplicableCoupons(c.Request.Context(), req)
+	resp, err := h.Service.BestCoupons(c.Request.Context(), req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, coupons)
+	c.JSON(http.StatusOK, resp)
 }
 
-// POST /coupons/validate
+// POST /coupons/validate, POST /coupons/redeem
 func (h *CouponHandler) ValidateCoupon(c *gin.Context) {
-	var req models.ValidateCouponRequest
+	req, ok := h.bindValidateRequest(c)
+	if !ok {
+		return
+	}
+
+	resp, err := h.Service.ValidateCoupon(c.Request.Context(), req)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// POST /coupons/quote
+func (h *CouponHandler) QuoteCoupon(c *gin.Context) {
+	req, ok := h.bindValidateRequest(c)
+	if !ok {
+		return
+	}
+
+	resp, err := h.Service.QuoteCoupon(c.Request.Context(), req)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// POST /coupons/stack/quote
+func (h *CouponHandler) QuoteStack(c *gin.Context) {
+	req, ok := h.bindStackRequest(c)
+	if !ok {
+		return
+	}
+
+	resp, err := h.Service.QuoteStack(c.Request.Context(), req)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// POST /coupons/stack/redeem
+func (h *CouponHandler) RedeemStack(c *gin.Context) {
+	req, ok := h.bindStackRequest(c)
+	if !ok {
+		return
+	}
+
+	resp, err := h.Service.RedeemStack(c.Request.Context(), req)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// POST /coupons/reserve
+func (h *CouponHandler) ReserveCoupon(c *gin.Context) {
+	var req models.ReserveCouponRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		respondBadRequest(c, "Invalid request body")
 		return
 	}
 
-	if req.Timestamp.IsZero() {
-		req.Timestamp = time.Now()
+	var ok bool
+	if req.IdempotencyKey, ok = idempotencyKey(c, req.IdempotencyKey); !ok {
+		return
 	}
 
 	if err := h.Validator.Struct(req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"validation_errors": formatValidationError(err)})
+		respondValidation(c, formatValidationError(err))
 		return
 	}
 
-	resp, err := h.Service.ValidateCoupon(c.Request.Context(), req)
+	resp, err := h.Service.ReserveCoupon(c.Request.Context(), req)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, resp)
+}
+
+// POST /coupons/reservations/:id/confirm
+func (h *CouponHandler) ConfirmReservation(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		respondBadRequest(c, "Invalid reservation id")
+		return
+	}
+
+	var req models.ConfirmReservationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBadRequest(c, "Invalid request body")
+		return
+	}
+
+	if err := h.Validator.Struct(req); err != nil {
+		respondValidation(c, formatValidationError(err))
+		return
+	}
+
+	usage, err := h.Service.ConfirmReservation(c.Request.Context(), id, req.OrderID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, usage)
+}
+
+// POST /coupons/reservations/:id/release
+func (h *CouponHandler) ReleaseReservation(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		respondBadRequest(c, "Invalid reservation id")
+		return
+	}
+
+	usage, err := h.Service.ReleaseReservation(c.Request.Context(), id)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, usage)
+}
+
+// POST /coupons/reversals
+func (h *CouponHandler) ReverseUsage(c *gin.Context) {
+	var req models.ReverseUsageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBadRequest(c, "Invalid request body")
+		return
+	}
+
+	if err := h.Validator.Struct(req); err != nil {
+		respondValidation(c, formatValidationError(err))
+		return
+	}
+
+	resp, err := h.Service.ReverseUsage(c.Request.Context(), req)
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, resp)
 }
+
+// bindValidateRequest parses and validates a ValidateCouponRequest body. When
+// it returns false the error response has already been written.
+func (h *CouponHandler) bindValidateRequest(c *gin.Context) (req models.ValidateCouponRequest, ok bool) {
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBadRequest(c, "Invalid request body")
+		return req, false
+	}
+
+	if req.IdempotencyKey, ok = idempotencyKey(c, req.IdempotencyKey); !ok {
+		return req, false
+	}
+
+	if err := h.Validator.Struct(req); err != nil {
+		respondValidation(c, formatValidationError(err))
+		return req, false
+	}
+	return req, true
+}
+
+// idempotencyKey merges the Idempotency-Key header into the key sent in the
+// body. When it returns false the error response has already been written.
+func idempotencyKey(c *gin.Context, bodyKey string) (string, bool) {
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		return bodyKey, true
+	}
+	if bodyKey != "" && bodyKey != key {
+		respondBadRequest(c, "Idempotency-Key header does not match idempotency_key")
+		return bodyKey, false
+	}
+	return key, true
+}
+
+func (h *CouponHandler) bindStackRequest(c *gin.Context) (req models.StackCouponsRequest, ok bool) {
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBadRequest(c, "Invalid request body")
+		return req, false
+	}
+
+	if req.IdempotencyKey, ok = idempotencyKey(c, req.IdempotencyKey); !ok {
+		return req, false
+	}
+
+	if err := h.Validator.Struct(req); err != nil {
+		respondValidation(c, formatValidationError(err))
+		return req, false
+	}
+	return req, true
+}
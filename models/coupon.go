@@ -1,6 +1,9 @@
 package models
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 type TimeWindow struct {
 	Start time.Time `json:"valid_start" validate:"required"`
@@ -8,17 +11,113 @@ type TimeWindow struct {
 }
 
 type Coupon struct {
-	CouponCode            string         `json:"coupon_code" validate:"required"`
-	DiscountType          DiscountType   `json:"discount_type" validate:"required"`
-	DiscountValue         float64        `json:"discount_value" validate:"required,gt=0"`
-	DiscountTarget        DiscountTarget `json:"discount_target" validate:"required"`
-	MinOrderValue         float64        `json:"min_order_value" validate:"gte=0"`
-	MaxUsagePerUser       int            `json:"max_usage_per_user" validate:"gte=0"`
-	ExpiryDate            time.Time      `json:"expiry_date" validate:"required"`
-	ApplicableMedicineIDs []string       `json:"applicable_medicine_ids" validate:"dive"`
-	ApplicableCategories  []string       `json:"applicable_categories" validate:"dive"`
-	UsageType             UsageType      `json:"usage_type" validate:"required"`
-	ValidTimeWindow       TimeWindow     `json:"valid_time_window" validate:"required"`
-	TermsAndConditions    string         `json:"terms_and_conditions"`
-	MaxDiscountAmount     float64        `json:"max_discount_amount" validate:"gte=0"`
-}
\ No newline at end of file
+	CouponCode              string             `json:"coupon_code" validate:"required"`
+	DiscountType            DiscountType       `json:"discount_type" validate:"required"`
+	DiscountValue           Money              `json:"discount_value" validate:"gte=0"` // an amount, or a percent for percentage types; must be positive unless the type is free_delivery
+	DiscountTarget          DiscountTarget     `json:"discount_target" validate:"required"`
+	MinOrderValue           Money              `json:"min_order_value" validate:"gte=0"`
+	MaxUsagePerUser         int                `json:"max_usage_per_user" validate:"gte=0"`
+	ExpiryDate              time.Time          `json:"expiry_date" validate:"required"`
+	ApplicableMedicineIDs   []string           `json:"applicable_medicine_ids" validate:"dive"`
+	ApplicableCategories    []string           `json:"applicable_categories" validate:"dive"`
+	ExcludedMedicineIDs     []string           `json:"excluded_medicine_ids" validate:"dive"` // never discounted, even when whitelisted
+	ExcludedCategories      []string           `json:"excluded_categories" validate:"dive"`
+	UsageType               UsageType          `json:"usage_type" validate:"required"`
+	ValidTimeWindow         TimeWindow         `json:"valid_time_window" validate:"required"`
+	Schedule                *RecurringSchedule `json:"schedule,omitempty" validate:"omitempty"`      // recurring slots inside ValidTimeWindow
+	SegmentRules            *SegmentRules      `json:"segment_rules,omitempty" validate:"omitempty"` // which customers may redeem, nil = everyone
+	TermsAndConditions      string             `json:"terms_and_conditions"`
+	MaxDiscountAmount       Money              `json:"max_discount_amount" validate:"gte=0"`
+	MaxTotalRedemptions     int                `json:"max_total_redemptions" validate:"gte=0"`                      // across all users, 0 = unlimited
+	MaxTotalDiscountBudget  Money              `json:"max_total_discount_budget" validate:"gte=0"`                  // across all users, 0 = unlimited
+	MinEligibleUnits        int                `json:"min_eligible_units" validate:"gte=0"`                         // units of eligible items the cart must hold
+	BuyXGetY                *BuyXGetY          `json:"buy_x_get_y,omitempty" validate:"omitempty"`                  // required for buy_x_get_y coupons
+	Tiers                   []DiscountTier     `json:"tiers,omitempty" validate:"omitempty,dive"`                   // higher spend thresholds, in ascending order
+	ApplicableDeliveryTypes []string           `json:"applicable_delivery_types" validate:"dive"`                   // empty means any delivery type
+	Currency                string             `json:"currency" validate:"omitempty,iso4217"`                       // ISO 4217 code of every amount on the coupon, defaults to INR
+	AllowCrossCurrency      bool               `json:"allow_cross_currency"`                                        // convert amounts for orders in other currencies instead of rejecting them
+	RoundingMode            RoundingMode       `json:"rounding_mode" validate:"omitempty,oneof=half_up floor ceil"` // defaults to half_up
+	RoundingUnit            Money              `json:"rounding_unit" validate:"gte=0"`                              // computed discounts are rounded to a multiple of this, defaults to 0.01
+	StackingGroup           string             `json:"stacking_group"`                                              // at most one coupon per group per order, empty = no group
+	Exclusive               bool               `json:"exclusive"`                                                   // never combined with any other coupon
+	Precedence              int                `json:"precedence"`                                                  // lower values are applied first when coupons are stacked
+	Status                  CouponStatus       `json:"status" validate:"omitempty,oneof=draft scheduled active paused archived"`
+	Version                 int                `json:"version"` // bumped on every update, used for optimistic locking
+
+	// Redemptions is filled in by the read endpoints and ignored on write.
+	Redemptions *RedemptionStats `json:"redemptions,omitempty"`
+}
+
+// RecurringSchedule limits a coupon to recurring slots, such as weekday
+// evenings, on the wall clock of an IANA timezone. Empty lists place no
+// restriction.
+type RecurringSchedule struct {
+	Timezone      string       `json:"timezone" validate:"required"`   // e.g. Asia/Kolkata
+	DaysOfWeek    []string     `json:"days_of_week" validate:"dive"`   // mon, tue, ... sun
+	HourWindows   []HourWindow `json:"hour_windows" validate:"dive"`   // any one must match
+	BlackoutDates []string     `json:"blackout_dates" validate:"dive"` // YYYY-MM-DD, local to Timezone
+}
+
+// SegmentRules restricts a coupon to a group of customers, judged against
+// their profile at redemption time. Every rule that is set must hold.
+type SegmentRules struct {
+	FirstOrderOnly        bool     `json:"first_order_only"`                                      // customer has no completed orders
+	MaxPriorOrders        *int     `json:"max_prior_orders,omitempty" validate:"omitempty,gte=0"` // at most this many completed orders
+	MinDaysSinceLastOrder int      `json:"min_days_since_last_order" validate:"gte=0"`            // lapsed customers only, never-ordered excluded, 0 = no restriction
+	RequiredSegments      []string `json:"required_segments" validate:"dive,required"`            // customer must belong to all of them
+}
+
+// HourWindow is a daily range written as HH:MM. End is exclusive and may be
+// 24:00; a window ending at or before its start runs past midnight.
+type HourWindow struct {
+	Start string `json:"start" validate:"required"`
+	End   string `json:"end" validate:"required"`
+}
+
+// Minutes returns the window as minutes since midnight.
+func (w HourWindow) Minutes() (start, end int, err error) {
+	if start, err = clockMinutes(w.Start); err != nil {
+		return 0, 0, err
+	}
+	if end, err = clockMinutes(w.End); err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+func clockMinutes(s string) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || len(s) != 5 {
+		return 0, fmt.Errorf("invalid time of day %q, want HH:MM", s)
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time of day %q, want HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+// BuyXGetY configures a buy_x_get_y coupon: for every BuyQuantity eligible
+// units bought, the next GetQuantity cheapest units are discounted by the
+// coupon's DiscountValue percent (100 makes them free).
+type BuyXGetY struct {
+	BuyQuantity int `json:"buy_quantity" validate:"gt=0"`
+	GetQuantity int `json:"get_quantity" validate:"gt=0"`
+}
+
+// DiscountTier replaces the coupon's own discount once the order total
+// reaches Threshold. The coupon's DiscountType and DiscountValue act as the
+// base tier, unlocked at MinOrderValue.
+type DiscountTier struct {
+	Threshold     Money        `json:"threshold" validate:"gt=0"`
+	DiscountType  DiscountType `json:"discount_type" validate:"required,oneof=flat percentage"`
+	DiscountValue Money        `json:"discount_value" validate:"gt=0"`
+}
+
+// RedemptionStats summarises how much of a coupon has been used so far.
+// Remaining values are nil when the matching cap is not set.
+type RedemptionStats struct {
+	TotalRedemptions        int    `json:"total_redemptions"`
+	TotalDiscountGiven      Money  `json:"total_discount_given"`
+	RemainingRedemptions    *int   `json:"remaining_redemptions,omitempty"`
+	RemainingDiscountBudget *Money `json:"remaining_discount_budget,omitempty"`
+}
@@ -3,14 +3,53 @@ package models
 type UsageType string
 type DiscountType string
 type DiscountTarget string
+type CouponStatus string
+type UsageStatus string
+type RoundingMode string
+type IneligibleReason string
 
 const (
 	UsageTypeSingleUse UsageType = "single_use"
 	UsageTypeMultiUse  UsageType = "multi_use"
 
-	DiscountTypeFlat      DiscountType = "flat"
-	DiscountTypePercentage DiscountType = "percentage"
+	DiscountTypeFlat         DiscountType = "flat"
+	DiscountTypePercentage   DiscountType = "percentage"
+	DiscountTypeBuyXGetY     DiscountType = "buy_x_get_y"   // DiscountValue is the percent taken off each "get" unit
+	DiscountTypeFreeDelivery DiscountType = "free_delivery" // waives the whole delivery fee, DiscountValue is unused
 
 	DiscountTargetDelivery DiscountTarget = "delivery"
 	DiscountTargetOrder    DiscountTarget = "total_order_value"
+
+	CouponStatusDraft     CouponStatus = "draft"
+	CouponStatusScheduled CouponStatus = "scheduled" // goes live on its own once ValidTimeWindow starts
+	CouponStatusActive    CouponStatus = "active"
+	CouponStatusPaused    CouponStatus = "paused"
+	CouponStatusArchived  CouponStatus = "archived"
+
+	RoundingModeHalfUp RoundingMode = "half_up"
+	RoundingModeFloor  RoundingMode = "floor"
+	RoundingModeCeil   RoundingMode = "ceil"
+
+	UsageStatusReserved  UsageStatus = "reserved"  // held for a checkout, counts toward limits until reserved_until
+	UsageStatusConfirmed UsageStatus = "confirmed" // redeemed against an order
+	UsageStatusReleased  UsageStatus = "released"
+	UsageStatusExpired   UsageStatus = "expired"
+	UsageStatusReversed  UsageStatus = "reversed" // undone after the order was cancelled or refunded
+
+	// Why GetApplicableCoupons left a coupon out, stable for clients to match on.
+	IneligibleInactive              IneligibleReason = "inactive"
+	IneligibleCurrencyMismatch      IneligibleReason = "currency_mismatch"
+	IneligibleRateUnavailable       IneligibleReason = "exchange_rate_unavailable"
+	IneligibleExpired               IneligibleReason = "expired"
+	IneligibleOutsideTimeWindow     IneligibleReason = "outside_time_window"
+	IneligibleOutsideSchedule       IneligibleReason = "outside_schedule"
+	IneligibleSegment               IneligibleReason = "segment_not_eligible"
+	IneligibleUsageLimitReached     IneligibleReason = "usage_limit_reached" // the user has used up their share
+	IneligibleDeliveryNotApplicable IneligibleReason = "delivery_not_applicable"
+	IneligibleAlreadyRedeemed       IneligibleReason = "already_redeemed"
+	IneligibleRedemptionCapReached  IneligibleReason = "redemption_limit_reached"
+	IneligibleBudgetExhausted       IneligibleReason = "budget_exhausted"
+	IneligibleNoEligibleItems       IneligibleReason = "no_eligible_items"
+	IneligibleNotEnoughUnits        IneligibleReason = "not_enough_units"
+	IneligibleBelowMinOrder         IneligibleReason = "below_min_order" // a near miss, AmountNeeded says by how much
 )
@@ -1,23 +1,292 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type ApplicableCouponsRequest struct {
-	CartItems  []CartItem `json:"cart_items" validate:"required,dive"`
-	OrderTotal float64    `json:"order_total" validate:"required,gt=0"`
-	Timestamp  time.Time  `json:"timestamp" validate:"required"`
+	UserID       string     `json:"user_id"` // optional, adds per-user limits and segment rules
+	CartItems    []CartItem `json:"cart_items" validate:"required,dive"`
+	OrderTotal   Money      `json:"order_total" validate:"required,gt=0"` // items only, excluding delivery
+	DeliveryFee  Money      `json:"delivery_fee" validate:"gte=0"`
+	DeliveryType string     `json:"delivery_type"`                         // e.g. standard, express
+	Currency     string     `json:"currency" validate:"omitempty,iso4217"` // defaults to INR
+	Timestamp    time.Time  `json:"timestamp"`                             // optional, server time wins if they drift apart
+}
+
+// ForCoupon returns the single-coupon request the cart would send to redeem code.
+func (r ApplicableCouponsRequest) ForCoupon(code string) ValidateCouponRequest {
+	return ValidateCouponRequest{
+		UserID:       r.UserID,
+		CouponCode:   code,
+		CartItems:    r.CartItems,
+		OrderTotal:   r.OrderTotal,
+		Timestamp:    r.Timestamp,
+		DeliveryFee:  r.DeliveryFee,
+		DeliveryType: r.DeliveryType,
+		Currency:     r.Currency,
+	}
 }
 
 type ValidateCouponRequest struct {
 	UserID     string     `json:"user_id" validate:"required"`
 	CouponCode string     `json:"coupon_code" validate:"required"`
 	CartItems  []CartItem `json:"cart_items" validate:"required,dive"`
-	OrderTotal float64    `json:"order_total" validate:"required,gt=0"`
-	Timestamp  time.Time  `json:"timestamp" validate:"required"`
+	OrderTotal Money      `json:"order_total" validate:"required,gt=0"` // items only, excluding delivery
+	Timestamp  time.Time  `json:"timestamp"`                            // optional, server time wins if they drift apart
+	OrderID    string     `json:"order_id"`                             // optional, ties the usage to an order for reversal and stacking rules
+
+	DeliveryFee  Money  `json:"delivery_fee" validate:"gte=0"`
+	DeliveryType string `json:"delivery_type"`                         // e.g. standard, express
+	Currency     string `json:"currency" validate:"omitempty,iso4217"` // defaults to INR
+
+	// IdempotencyKey makes retries safe: a repeated key returns the first
+	// response instead of recording another usage. The Idempotency-Key
+	// header fills it in when the body leaves it empty.
+	IdempotencyKey string `json:"idempotency_key" validate:"omitempty,max=255"`
+}
+
+// StackCouponsRequest applies several coupons to one order. Each code is
+// checked as if it were sent alone, then the stacking rules decide which of
+// them combine.
+type StackCouponsRequest struct {
+	UserID      string     `json:"user_id" validate:"required"`
+	CouponCodes []string   `json:"coupon_codes" validate:"required,min=1,max=10,dive,required"`
+	CartItems   []CartItem `json:"cart_items" validate:"required,dive"`
+	OrderTotal  Money      `json:"order_total" validate:"required,gt=0"` // items only, excluding delivery
+	Timestamp   time.Time  `json:"timestamp"`                            // optional, server time wins if they drift apart
+	OrderID     string     `json:"order_id"`                             // optional, ties the usages to an order for reversal and stacking rules
+
+	DeliveryFee  Money  `json:"delivery_fee" validate:"gte=0"`
+	DeliveryType string `json:"delivery_type"`                         // e.g. standard, express
+	Currency     string `json:"currency" validate:"omitempty,iso4217"` // defaults to INR
+
+	// IdempotencyKey makes retried redemptions safe, as it does for a single
+	// coupon. It is ignored by quotes, which record nothing.
+	IdempotencyKey string `json:"idempotency_key" validate:"omitempty,max=255"`
+}
+
+// ForCoupon returns the single-coupon request for one of the stacked codes.
+func (r StackCouponsRequest) ForCoupon(code string) ValidateCouponRequest {
+	return ValidateCouponRequest{
+		UserID:       r.UserID,
+		CouponCode:   code,
+		CartItems:    r.CartItems,
+		OrderTotal:   r.OrderTotal,
+		Timestamp:    r.Timestamp,
+		OrderID:      r.OrderID,
+		DeliveryFee:  r.DeliveryFee,
+		DeliveryType: r.DeliveryType,
+		Currency:     r.Currency,
+	}
 }
 
 type CartItem struct {
-	ID       string  `json:"medicine_id" validate:"required"`
-	Category string  `json:"category" validate:"required"`
-	Price    float64 `json:"price" validate:"required,gt=0"`
+	ID       string `json:"medicine_id" validate:"required"`
+	Category string `json:"category" validate:"required"`
+	Price    Money  `json:"price" validate:"required,gt=0"` // per unit
+	Quantity int    `json:"quantity" validate:"gte=0"`      // 0 is read as 1 for older clients
+}
+
+// Units is the number of units on the line.
+func (i CartItem) Units() int {
+	if i.Quantity <= 0 {
+		return 1
+	}
+	return i.Quantity
+}
+
+// LineTotal is the price of every unit on the line.
+func (i CartItem) LineTotal() Money {
+	return i.Price * Money(i.Units())
+}
+
+// ListCouponsRequest carries the query-string filters accepted by GET /api/coupons.
+type ListCouponsRequest struct {
+	DiscountType   DiscountType   `form:"discount_type" validate:"omitempty,oneof=flat percentage buy_x_get_y free_delivery"`
+	DiscountTarget DiscountTarget `form:"discount_target" validate:"omitempty,oneof=delivery total_order_value"`
+	Category       string         `form:"category"`
+	MedicineID     string         `form:"medicine_id"`
+	Status         CouponStatus   `form:"status" validate:"omitempty,oneof=draft scheduled active paused archived"`
+	Expired        *bool          `form:"expired"`
+	ExpiresAfter   time.Time      `form:"expires_after"`
+	ExpiresBefore  time.Time      `form:"expires_before"`
+	Cursor         string         `form:"cursor"`
+	Limit          int            `form:"limit" validate:"gte=0,lte=100"`
+}
+
+// Nullable is a patch field that can be left out, set, or cleared by sending
+// null, which a plain pointer cannot tell apart from leaving it out.
+type Nullable[T any] struct {
+	Set   bool // the field was in the body
+	Value *T   // nil when the field was sent as null
+}
+
+func (n *Nullable[T]) UnmarshalJSON(b []byte) error {
+	n.Set = true
+	if string(b) == "null" {
+		n.Value = nil
+		return nil
+	}
+	var v T
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	n.Value = &v
+	return nil
+}
+
+// CouponPatch is the body of PATCH /api/coupons/:code. Nil fields are left
+// untouched; schedule, segment_rules and buy_x_get_y may also be sent as null
+// to remove them. Version must match the stored coupon or the update is
+// rejected.
+type CouponPatch struct {
+	DiscountType            *DiscountType               `json:"discount_type"`
+	DiscountValue           *Money                      `json:"discount_value"`
+	DiscountTarget          *DiscountTarget             `json:"discount_target"`
+	MinOrderValue           *Money                      `json:"min_order_value"`
+	MaxUsagePerUser         *int                        `json:"max_usage_per_user"`
+	ExpiryDate              *time.Time                  `json:"expiry_date"`
+	ApplicableMedicineIDs   *[]string                   `json:"applicable_medicine_ids"`
+	ApplicableCategories    *[]string                   `json:"applicable_categories"`
+	ExcludedMedicineIDs     *[]string                   `json:"excluded_medicine_ids"`
+	ExcludedCategories      *[]string                   `json:"excluded_categories"`
+	UsageType               *UsageType                  `json:"usage_type"`
+	ValidTimeWindow         *TimeWindow                 `json:"valid_time_window"`
+	Schedule                Nullable[RecurringSchedule] `json:"schedule"`
+	SegmentRules            Nullable[SegmentRules]      `json:"segment_rules"`
+	StackingGroup           *string                     `json:"stacking_group"`
+	Exclusive               *bool                       `json:"exclusive"`
+	Precedence              *int                        `json:"precedence"`
+	TermsAndConditions      *string                     `json:"terms_and_conditions"`
+	MaxDiscountAmount       *Money                      `json:"max_discount_amount"`
+	MaxTotalRedemptions     *int                        `json:"max_total_redemptions"`
+	MaxTotalDiscountBudget  *Money                      `json:"max_total_discount_budget"`
+	MinEligibleUnits        *int                        `json:"min_eligible_units"`
+	BuyXGetY                Nullable[BuyXGetY]          `json:"buy_x_get_y"`
+	Tiers                   *[]DiscountTier             `json:"tiers"`
+	RoundingMode            *RoundingMode               `json:"rounding_mode"`
+	RoundingUnit            *Money                      `json:"rounding_unit"`
+	Currency                *string                     `json:"currency" validate:"omitempty,iso4217"`
+	AllowCrossCurrency      *bool                       `json:"allow_cross_currency"`
+	ApplicableDeliveryTypes *[]string                   `json:"applicable_delivery_types"`
+	Version                 int                         `json:"version" validate:"required,gt=0"`
+}
+
+// ApplyTo copies every non-nil field of p onto c, and every Nullable field
+// that was sent, clearing those sent as null.
+func (p CouponPatch) ApplyTo(c *Coupon) {
+	if p.DiscountType != nil {
+		c.DiscountType = *p.DiscountType
+	}
+	if p.DiscountValue != nil {
+		c.DiscountValue = *p.DiscountValue
+	}
+	if p.DiscountTarget != nil {
+		c.DiscountTarget = *p.DiscountTarget
+	}
+	if p.MinOrderValue != nil {
+		c.MinOrderValue = *p.MinOrderValue
+	}
+	if p.MaxUsagePerUser != nil {
+		c.MaxUsagePerUser = *p.MaxUsagePerUser
+	}
+	if p.ExpiryDate != nil {
+		c.ExpiryDate = *p.ExpiryDate
+	}
+	if p.ApplicableMedicineIDs != nil {
+		c.ApplicableMedicineIDs = *p.ApplicableMedicineIDs
+	}
+	if p.ApplicableCategories != nil {
+		c.ApplicableCategories = *p.ApplicableCategories
+	}
+	if p.ExcludedMedicineIDs != nil {
+		c.ExcludedMedicineIDs = *p.ExcludedMedicineIDs
+	}
+	if p.ExcludedCategories != nil {
+		c.ExcludedCategories = *p.ExcludedCategories
+	}
+	if p.UsageType != nil {
+		c.UsageType = *p.UsageType
+	}
+	if p.ValidTimeWindow != nil {
+		c.ValidTimeWindow = *p.ValidTimeWindow
+	}
+	if p.Schedule.Set {
+		c.Schedule = p.Schedule.Value
+	}
+	if p.SegmentRules.Set {
+		c.SegmentRules = p.SegmentRules.Value
+	}
+	if p.StackingGroup != nil {
+		c.StackingGroup = *p.StackingGroup
+	}
+	if p.Exclusive != nil {
+		c.Exclusive = *p.Exclusive
+	}
+	if p.Precedence != nil {
+		c.Precedence = *p.Precedence
+	}
+	if p.TermsAndConditions != nil {
+		c.TermsAndConditions = *p.TermsAndConditions
+	}
+	if p.MaxDiscountAmount != nil {
+		c.MaxDiscountAmount = *p.MaxDiscountAmount
+	}
+	if p.MaxTotalRedemptions != nil {
+		c.MaxTotalRedemptions = *p.MaxTotalRedemptions
+	}
+	if p.MaxTotalDiscountBudget != nil {
+		c.MaxTotalDiscountBudget = *p.MaxTotalDiscountBudget
+	}
+	if p.MinEligibleUnits != nil {
+		c.MinEligibleUnits = *p.MinEligibleUnits
+	}
+	if p.BuyXGetY.Set {
+		c.BuyXGetY = p.BuyXGetY.Value
+	}
+	if p.Tiers != nil {
+		c.Tiers = *p.Tiers
+	}
+	if p.RoundingMode != nil {
+		c.RoundingMode = *p.RoundingMode
+	}
+	if p.RoundingUnit != nil {
+		c.RoundingUnit = *p.RoundingUnit
+	}
+	if p.Currency != nil {
+		c.Currency = *p.Currency
+	}
+	if p.AllowCrossCurrency != nil {
+		c.AllowCrossCurrency = *p.AllowCrossCurrency
+	}
+	if p.ApplicableDeliveryTypes != nil {
+		c.ApplicableDeliveryTypes = *p.ApplicableDeliveryTypes
+	}
+	c.Version = p.Version
+}
+
+type CouponStatusRequest struct {
+	Status CouponStatus `json:"status" validate:"required,oneof=draft scheduled active paused archived"`
+}
+
+// ReserveCouponRequest holds a coupon for an order that is still being placed.
+// OrderID, when given, is stored on the reservation and must match the order
+// it is confirmed for.
+type ReserveCouponRequest struct {
+	ValidateCouponRequest
+	TTLSeconds int `json:"ttl_seconds" validate:"gte=0,lte=3600"` // 0 uses the service default
+}
+
+type ConfirmReservationRequest struct {
+	OrderID string `json:"order_id" validate:"required"`
+}
+
+// ReverseUsageRequest identifies the redemptions to undo, either a single
+// usage or every confirmed usage attached to an order.
+type ReverseUsageRequest struct {
+	UsageID int64  `json:"usage_id" validate:"required_without=OrderID"`
+	OrderID string `json:"order_id" validate:"required_without=UsageID"`
+	Reason  string `json:"reason" validate:"required"`
 }
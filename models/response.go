@@ -1,7 +1,155 @@
 package models
 
+import "time"
+
 type ValidateCouponResponse struct {
-	IsValid  bool               `json:"is_valid"`
-	Discount map[string]float64 `json:"discount"` // e.g., {"medicine": 25.0}
-	Message  string             `json:"message"`
+	IsValid   bool               `json:"is_valid"`
+	Currency  string             `json:"currency"`
+	Discount  map[string]Money   `json:"discount"`               // e.g., {"total_order_value": 25.00}
+	LineItems []LineItemDiscount `json:"line_items,omitempty"`   // how an order discount splits across the cart
+	FreeUnits []FreeUnit         `json:"free_units,omitempty"`   // units discounted by a buy_x_get_y coupon
+	Tier      *DiscountTier      `json:"applied_tier,omitempty"` // set when a spend tier beat the base discount
+	ClockSkew bool               `json:"clock_skew,omitempty"`   // the client timestamp was ignored in favour of server time
+	Message   string             `json:"message"`
+	UsageID   int64              `json:"usage_id,omitempty"` // set once the usage is recorded
+}
+
+// StackCouponsResponse sums the coupons that were applied together and
+// reports on every code that was sent.
+type StackCouponsResponse struct {
+	IsValid       bool             `json:"is_valid"` // at least one coupon was applied
+	Currency      string           `json:"currency"`
+	Discount      map[string]Money `json:"discount"` // combined, keyed by discount target
+	TotalDiscount Money            `json:"total_discount"`
+	Coupons       []StackedCoupon  `json:"coupons"` // in the order they were requested
+	ClockSkew     bool             `json:"clock_skew,omitempty"`
+	Message       string           `json:"message"`
+}
+
+// StackedCoupon is one coupon's share of a stacked discount, or the reason it
+// was left out.
+type StackedCoupon struct {
+	CouponCode string             `json:"coupon_code"`
+	Applied    bool               `json:"applied"`
+	Discount   map[string]Money   `json:"discount,omitempty"`
+	LineItems  []LineItemDiscount `json:"line_items,omitempty"`
+	FreeUnits  []FreeUnit         `json:"free_units,omitempty"`
+	Tier       *DiscountTier      `json:"applied_tier,omitempty"`
+	UsageID    int64              `json:"usage_id,omitempty"` // set once the usage is recorded
+	Code       string             `json:"code,omitempty"`     // stable error code for a rejected coupon, e.g. COUPON_EXPIRED
+	Reason     string             `json:"reason,omitempty"`   // why the coupon was rejected
+}
+
+// BestCouponsResponse ranks every way the cart can use its coupons, alone or
+// stacked, by what the customer saves.
+type BestCouponsResponse struct {
+	Currency string         `json:"currency"`
+	Options  []CouponOption `json:"options"` // biggest saving first
+
+	// Truncated is set when the cart allows more combinations than are
+	// priced, so a better stack than the recommended one may exist.
+	Truncated bool `json:"truncated"`
+}
+
+// CouponOption is one coupon, or one legal stack of coupons, priced against
+// the cart.
+type CouponOption struct {
+	CouponCodes   []string         `json:"coupon_codes"` // in the order they are applied
+	Discount      map[string]Money `json:"discount"`
+	TotalDiscount Money            `json:"total_discount"`
+	Coupons       []StackedCoupon  `json:"coupons"`
+	Recommended   bool             `json:"recommended"` // set on the option the cart should use
+}
+
+// LineItemDiscount is the share of an order-level discount given to one cart line.
+type LineItemDiscount struct {
+	MedicineID     string `json:"medicine_id"`
+	Category       string `json:"category"`
+	Quantity       int    `json:"quantity"`
+	EligibleAmount Money  `json:"eligible_amount"` // unit price times quantity
+	Discount       Money  `json:"discount"`
+}
+
+// ApplicableCouponsResponse splits the live coupons into those the cart can
+// use, each priced against it, and those it cannot, each with a reason.
+type ApplicableCouponsResponse struct {
+	Currency   string             `json:"currency"`
+	Applicable []ApplicableCoupon `json:"applicable"` // biggest saving first
+	Ineligible []IneligibleCoupon `json:"ineligible"`
+}
+
+// CouponSummary is the part of a coupon a customer is shown.
+type CouponSummary struct {
+	CouponCode         string         `json:"coupon_code"`
+	DiscountType       DiscountType   `json:"discount_type"`
+	DiscountValue      Money          `json:"discount_value"`
+	DiscountTarget     DiscountTarget `json:"discount_target"`
+	ExpiryDate         time.Time      `json:"expiry_date"`
+	TermsAndConditions string         `json:"terms_and_conditions"`
+}
+
+// ApplicableCoupon is a coupon the cart qualifies for and what it would save.
+type ApplicableCoupon struct {
+	CouponSummary
+	Discount      map[string]Money `json:"discount"`
+	TotalDiscount Money            `json:"total_discount"`
+	Headroom      *Money           `json:"headroom,omitempty"`  // further discount a bigger cart could get before max_discount_amount, nil when uncapped
+	NextTier      *NextTier        `json:"next_tier,omitempty"` // the next spend tier the cart could unlock
+	Redemptions   *RedemptionStats `json:"redemptions,omitempty"`
+}
+
+// IneligibleCoupon is a live coupon the cart does not qualify for.
+type IneligibleCoupon struct {
+	CouponSummary
+	Reason       IneligibleReason `json:"reason"`
+	Message      string           `json:"message"`
+	AmountNeeded *Money           `json:"amount_needed,omitempty"` // extra spend that unlocks a below_min_order coupon
+	UnitsNeeded  int              `json:"units_needed,omitempty"`  // extra eligible units for not_enough_units
+}
+
+// NextTier tells the cart how much more it has to spend to reach a better tier.
+type NextTier struct {
+	DiscountTier
+	AmountNeeded Money `json:"amount_needed"`
+}
+
+type CouponListResponse struct {
+	Coupons    []Coupon `json:"coupons"`
+	NextCursor string   `json:"next_cursor,omitempty"` // empty on the last page
+}
+
+type ReserveCouponResponse struct {
+	ReservationID int64              `json:"reservation_id"`
+	IsValid       bool               `json:"is_valid"`
+	Currency      string             `json:"currency"`
+	Discount      map[string]Money   `json:"discount"`
+	LineItems     []LineItemDiscount `json:"line_items,omitempty"`
+	FreeUnits     []FreeUnit         `json:"free_units,omitempty"`
+	Tier          *DiscountTier      `json:"applied_tier,omitempty"`
+	ExpiresAt     time.Time          `json:"expires_at"`
+	ClockSkew     bool               `json:"clock_skew,omitempty"`
+	Message       string             `json:"message"`
+}
+
+// FreeUnit records how many units of a cart line a buy_x_get_y coupon
+// discounted. The money involved is reported on the matching line item.
+type FreeUnit struct {
+	MedicineID string `json:"medicine_id"`
+	Quantity   int    `json:"quantity"`
+	UnitPrice  Money  `json:"unit_price"`
+}
+
+type ReverseUsageResponse struct {
+	Reversed []CouponUsage `json:"reversed"`
+}
+
+// ErrorResponse is the body of every failed request.
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+type ErrorBody struct {
+	Code    string            `json:"code"` // stable, e.g. COUPON_EXPIRED or VALIDATION_FAILED
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"` // per-field problems for VALIDATION_FAILED
 }
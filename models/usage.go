@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// CouponUsage is one row of coupon_usages: a redemption, or a reservation
+// that has not been confirmed yet.
+type CouponUsage struct {
+	ID            int64       `json:"id"`
+	UserID        string      `json:"user_id"`
+	CouponCode    string      `json:"coupon_code"`
+	Status        UsageStatus `json:"status"`
+	OrderID       string      `json:"order_id,omitempty"`
+	UsedAt        time.Time   `json:"used_at"`
+	ReservedUntil *time.Time  `json:"reserved_until,omitempty"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// UserProfile holds the facts about a customer that segment rules are
+// judged against. A user with no profile is a new customer.
+type UserProfile struct {
+	UserID      string     `json:"user_id"`
+	OrderCount  int        `json:"order_count"`             // completed orders so far
+	LastOrderAt *time.Time `json:"last_order_at,omitempty"` // nil before the first order
+	Segments    []string   `json:"segments"`                // e.g. chronic_care_subscriber
+}
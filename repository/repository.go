@@ -4,13 +4,27 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/Puneet-Vishnoi/Coupon-System/db/postgres/providers"
 	"github.com/Puneet-Vishnoi/Coupon-System/models"
+	"github.com/lib/pq"
 )
 
+// ErrDuplicateKey is returned when an insert hits a unique constraint.
+var ErrDuplicateKey = errors.New("duplicate key")
+
+// IsSerializationFailure reports whether err is Postgres aborting a
+// serializable transaction that raced another one. Such a transaction can
+// be retried from the start.
+func IsSerializationFailure(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "40001"
+}
+
 type CouponRepository struct {
 	DBHelper *providers.DBHelper
 }
@@ -34,6 +48,47 @@ func (r *CouponRepository) CreateCoupon(ctx context.Context, tx *sql.Tx, c *mode
 		return fmt.Errorf("failed to marshal categories: %w", err)
 	}
 
+	var bxgy []byte
+	if c.BuyXGetY != nil {
+		if bxgy, err = json.Marshal(c.BuyXGetY); err != nil {
+			return fmt.Errorf("failed to marshal buy_x_get_y: %w", err)
+		}
+	}
+
+	tiers, err := json.Marshal(c.Tiers)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tiers: %w", err)
+	}
+
+	var schedule []byte
+	if c.Schedule != nil {
+		if schedule, err = json.Marshal(c.Schedule); err != nil {
+			return fmt.Errorf("failed to marshal schedule: %w", err)
+		}
+	}
+
+	var segmentRules []byte
+	if c.SegmentRules != nil {
+		if segmentRules, err = json.Marshal(c.SegmentRules); err != nil {
+			return fmt.Errorf("failed to marshal segment rules: %w", err)
+		}
+	}
+
+	excludedMeds, err := json.Marshal(c.ExcludedMedicineIDs)
+	if err != nil {
+		return fmt.Errorf("failed to marshal excluded medicine IDs: %w", err)
+	}
+
+	excludedCats, err := json.Marshal(c.ExcludedCategories)
+	if err != nil {
+		return fmt.Errorf("failed to marshal excluded categories: %w", err)
+	}
+
+	deliveryTypes, err := json.Marshal(c.ApplicableDeliveryTypes)
+	if err != nil {
+		return fmt.Errorf("failed to marshal delivery types: %w", err)
+	}
+
 	_, err = tx.ExecContext(ctx, `
 		INSERT INTO coupons (
 			coupon_code,
@@ -49,8 +104,26 @@ func (r *CouponRepository) CreateCoupon(ctx context.Context, tx *sql.Tx, c *mode
 			valid_start,
 			valid_end,
 			terms_and_conditions,
-			max_discount_amount
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+			max_discount_amount,
+			status,
+			max_total_redemptions,
+			max_total_discount_budget,
+			min_eligible_units,
+			buy_x_get_y,
+			tiers,
+			applicable_delivery_types,
+			rounding_mode,
+			rounding_unit,
+			currency,
+			allow_cross_currency,
+			excluded_medicine_ids,
+			excluded_categories,
+			schedule,
+			segment_rules,
+			stacking_group,
+			exclusive,
+			precedence
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32)
 	`,
 		c.CouponCode,
 		c.DiscountType,
@@ -66,154 +139,690 @@ func (r *CouponRepository) CreateCoupon(ctx context.Context, tx *sql.Tx, c *mode
 		c.ValidTimeWindow.End,
 		c.TermsAndConditions,
 		c.MaxDiscountAmount,
+		c.Status,
+		c.MaxTotalRedemptions,
+		c.MaxTotalDiscountBudget,
+		c.MinEligibleUnits,
+		bxgy,
+		tiers,
+		deliveryTypes,
+		c.RoundingMode,
+		c.RoundingUnit,
+		c.Currency,
+		c.AllowCrossCurrency,
+		excludedMeds,
+		excludedCats,
+		schedule,
+		segmentRules,
+		c.StackingGroup,
+		c.Exclusive,
+		c.Precedence,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to insert coupon: %w", err)
 	}
+	c.Version = 1
 	return nil
 }
 
-func (r *CouponRepository) GetAllCoupons(ctx context.Context) ([]*models.Coupon, error) {
-	rows, err := r.DBHelper.PostgresClient.QueryContext(ctx, `
-		SELECT 
+// CouponFilter narrows the result of GetAllCoupons. Zero-valued fields are ignored.
+type CouponFilter struct {
+	DiscountType   models.DiscountType
+	DiscountTarget models.DiscountTarget
+	Status         models.CouponStatus
+	Category       string
+	MedicineID     string
+	Expired        *bool
+	ExpiresAfter   time.Time
+	ExpiresBefore  time.Time
+	AfterCode      string
+	Limit          int
+	Now            time.Time
+}
+
+// couponColumns is the column list shared by every query that loads a full coupon row.
+const couponColumns = `
 			coupon_code, expiry_date, usage_type, 
 			applicable_medicine_ids, applicable_categories, 
 			min_order_value, valid_start, valid_end, 
 			terms_and_conditions, discount_type, discount_value, 
-			max_usage_per_user, discount_target, max_discount_amount
-		FROM coupons
-	`)
+			max_usage_per_user, discount_target, max_discount_amount,
+			version, status,
+			max_total_redemptions, max_total_discount_budget,
+			min_eligible_units, buy_x_get_y, tiers,
+			applicable_delivery_types, rounding_mode, rounding_unit,
+			currency, allow_cross_currency,
+			excluded_medicine_ids, excluded_categories, schedule,
+			segment_rules, stacking_group, exclusive, precedence`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanCoupon reads a single row selected with couponColumns.
+func scanCoupon(row rowScanner) (models.Coupon, error) {
+	var c models.Coupon
+	var meds, cats, excludedMeds, excludedCats, bxgy, tiers, deliveryTypes, schedule, segmentRules []byte
+
+	err := row.Scan(
+		&c.CouponCode, &c.ExpiryDate, &c.UsageType,
+		&meds, &cats,
+		&c.MinOrderValue, &c.ValidTimeWindow.Start, &c.ValidTimeWindow.End,
+		&c.TermsAndConditions, &c.DiscountType, &c.DiscountValue,
+		&c.MaxUsagePerUser, &c.DiscountTarget, &c.MaxDiscountAmount,
+		&c.Version, &c.Status,
+		&c.MaxTotalRedemptions, &c.MaxTotalDiscountBudget,
+		&c.MinEligibleUnits, &bxgy, &tiers,
+		&deliveryTypes, &c.RoundingMode, &c.RoundingUnit,
+		&c.Currency, &c.AllowCrossCurrency,
+		&excludedMeds, &excludedCats, &schedule,
+		&segmentRules, &c.StackingGroup, &c.Exclusive, &c.Precedence,
+	)
 	if err != nil {
-		return nil, err
+		return c, err
 	}
-	defer rows.Close()
 
-	var coupons []*models.Coupon
+	if err := json.Unmarshal(meds, &c.ApplicableMedicineIDs); err != nil {
+		return c, fmt.Errorf("failed to unmarshal medicine IDs: %w", err)
+	}
+	if err := json.Unmarshal(cats, &c.ApplicableCategories); err != nil {
+		return c, fmt.Errorf("failed to unmarshal categories: %w", err)
+	}
+	if err := json.Unmarshal(excludedMeds, &c.ExcludedMedicineIDs); err != nil {
+		return c, fmt.Errorf("failed to unmarshal excluded medicine IDs: %w", err)
+	}
+	if err := json.Unmarshal(excludedCats, &c.ExcludedCategories); err != nil {
+		return c, fmt.Errorf("failed to unmarshal excluded categories: %w", err)
+	}
+	if len(bxgy) > 0 {
+		if err := json.Unmarshal(bxgy, &c.BuyXGetY); err != nil {
+			return c, fmt.Errorf("failed to unmarshal buy_x_get_y: %w", err)
+		}
+	}
+	if len(schedule) > 0 {
+		if err := json.Unmarshal(schedule, &c.Schedule); err != nil {
+			return c, fmt.Errorf("failed to unmarshal schedule: %w", err)
+		}
+	}
+	if len(segmentRules) > 0 {
+		if err := json.Unmarshal(segmentRules, &c.SegmentRules); err != nil {
+			return c, fmt.Errorf("failed to unmarshal segment rules: %w", err)
+		}
+	}
+	if err := json.Unmarshal(tiers, &c.Tiers); err != nil {
+		return c, fmt.Errorf("failed to unmarshal tiers: %w", err)
+	}
+	if err := json.Unmarshal(deliveryTypes, &c.ApplicableDeliveryTypes); err != nil {
+		return c, fmt.Errorf("failed to unmarshal delivery types: %w", err)
+	}
+
+	return c, nil
+}
+
+func scanCoupons(rows *sql.Rows) ([]models.Coupon, error) {
+	defer rows.Close()
 
+	var coupons []models.Coupon
 	for rows.Next() {
-		var c models.Coupon
-		var meds, cats []byte
-
-		err := rows.Scan(
-			&c.CouponCode, &c.ExpiryDate, &c.UsageType,
-			&meds, &cats,
-			&c.MinOrderValue, &c.ValidTimeWindow.Start, &c.ValidTimeWindow.End,
-			&c.TermsAndConditions, &c.DiscountType, &c.DiscountValue,
-			&c.MaxUsagePerUser, &c.DiscountTarget, &c.MaxDiscountAmount,
-		)
+		c, err := scanCoupon(rows)
 		if err != nil {
 			return nil, err
 		}
+		coupons = append(coupons, c)
+	}
+	return coupons, rows.Err()
+}
 
-		if err := json.Unmarshal(meds, &c.ApplicableMedicineIDs); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal medicine IDs: %w", err)
-		}
-		if err := json.Unmarshal(cats, &c.ApplicableCategories); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal categories: %w", err)
+// GetAllCoupons lists coupons ordered by coupon code, starting after
+// filter.AfterCode so callers can page through the table with a cursor.
+func (r *CouponRepository) GetAllCoupons(ctx context.Context, filter CouponFilter) ([]models.Coupon, error) {
+	var conds []string
+	var args []interface{}
+	where := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	if filter.DiscountType != "" {
+		where("discount_type = $%d", filter.DiscountType)
+	}
+	if filter.DiscountTarget != "" {
+		where("discount_target = $%d", filter.DiscountTarget)
+	}
+	if filter.Status != "" {
+		where("status = $%d", filter.Status)
+	}
+	if filter.Category != "" {
+		cat, _ := json.Marshal([]string{filter.Category})
+		where("applicable_categories @> $%d::jsonb", cat)
+	}
+	if filter.MedicineID != "" {
+		med, _ := json.Marshal([]string{filter.MedicineID})
+		where("applicable_medicine_ids @> $%d::jsonb", med)
+	}
+	if filter.Expired != nil {
+		if *filter.Expired {
+			where("expiry_date < $%d", filter.Now)
+		} else {
+			where("expiry_date >= $%d", filter.Now)
 		}
+	}
+	if !filter.ExpiresAfter.IsZero() {
+		where("expiry_date >= $%d", filter.ExpiresAfter)
+	}
+	if !filter.ExpiresBefore.IsZero() {
+		where("expiry_date <= $%d", filter.ExpiresBefore)
+	}
+	if filter.AfterCode != "" {
+		where("coupon_code > $%d", filter.AfterCode)
+	}
+
+	query := "SELECT " + couponColumns + "\n\t\tFROM coupons"
+	if len(conds) > 0 {
+		query += "\n\t\tWHERE " + strings.Join(conds, " AND ")
+	}
+	query += "\n\t\tORDER BY coupon_code"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf("\n\t\tLIMIT $%d", len(args))
+	}
 
-		coupons = append(coupons, &c)
+	rows, err := r.DBHelper.PostgresClient.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
 	}
-	return coupons, nil
+	return scanCoupons(rows)
 }
 
+// GetCouponByCode loads a coupon and locks its row for the rest of tx.
 func (r *CouponRepository) GetCouponByCode(ctx context.Context, tx *sql.Tx, code string) (models.Coupon, error) {
-	var c models.Coupon
-	var meds, cats []byte
-
-	err := tx.QueryRowContext(ctx, `
-		SELECT 
-			coupon_code, expiry_date, usage_type, 
-			applicable_medicine_ids, applicable_categories, 
-			min_order_value, valid_start, valid_end, 
-			terms_and_conditions, discount_type, discount_value, 
-			max_usage_per_user, discount_target, max_discount_amount
+	return scanCoupon(tx.QueryRowContext(ctx, `
+		SELECT `+couponColumns+`
 		FROM coupons
 		WHERE coupon_code = $1
 		FOR UPDATE
-	`, code).Scan(
-		&c.CouponCode, &c.ExpiryDate, &c.UsageType,
-		&meds, &cats,
-		&c.MinOrderValue, &c.ValidTimeWindow.Start, &c.ValidTimeWindow.End,
-		&c.TermsAndConditions, &c.DiscountType, &c.DiscountValue,
-		&c.MaxUsagePerUser, &c.DiscountTarget, &c.MaxDiscountAmount,
-	)
+	`, code))
+}
+
+// FindCouponByCode loads a coupon outside of any transaction, for read-only callers.
+func (r *CouponRepository) FindCouponByCode(ctx context.Context, code string) (models.Coupon, error) {
+	return scanCoupon(r.DBHelper.PostgresClient.QueryRowContext(ctx, `
+		SELECT `+couponColumns+`
+		FROM coupons
+		WHERE coupon_code = $1
+	`, code))
+}
+
+// UpdateCoupon overwrites the stored coupon if its version still equals
+// c.Version, and sets c.Version to the new version. sql.ErrNoRows means the
+// row is missing or was changed concurrently.
+func (r *CouponRepository) UpdateCoupon(ctx context.Context, tx *sql.Tx, c *models.Coupon) error {
+	if c.DiscountValue < 0 {
+		return fmt.Errorf("discount cannot be negative")
+	}
+
+	meds, err := json.Marshal(c.ApplicableMedicineIDs)
 	if err != nil {
-		return c, err
+		return fmt.Errorf("failed to marshal medicine IDs: %w", err)
 	}
 
-	if err := json.Unmarshal(meds, &c.ApplicableMedicineIDs); err != nil {
-		return c, fmt.Errorf("failed to unmarshal medicine IDs: %w", err)
+	cats, err := json.Marshal(c.ApplicableCategories)
+	if err != nil {
+		return fmt.Errorf("failed to marshal categories: %w", err)
 	}
-	if err := json.Unmarshal(cats, &c.ApplicableCategories); err != nil {
-		return c, fmt.Errorf("failed to unmarshal categories: %w", err)
+
+	var bxgy []byte
+	if c.BuyXGetY != nil {
+		if bxgy, err = json.Marshal(c.BuyXGetY); err != nil {
+			return fmt.Errorf("failed to marshal buy_x_get_y: %w", err)
+		}
 	}
 
-	return c, nil
+	tiers, err := json.Marshal(c.Tiers)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tiers: %w", err)
+	}
+
+	var schedule []byte
+	if c.Schedule != nil {
+		if schedule, err = json.Marshal(c.Schedule); err != nil {
+			return fmt.Errorf("failed to marshal schedule: %w", err)
+		}
+	}
+
+	var segmentRules []byte
+	if c.SegmentRules != nil {
+		if segmentRules, err = json.Marshal(c.SegmentRules); err != nil {
+			return fmt.Errorf("failed to marshal segment rules: %w", err)
+		}
+	}
+
+	excludedMeds, err := json.Marshal(c.ExcludedMedicineIDs)
+	if err != nil {
+		return fmt.Errorf("failed to marshal excluded medicine IDs: %w", err)
+	}
+
+	excludedCats, err := json.Marshal(c.ExcludedCategories)
+	if err != nil {
+		return fmt.Errorf("failed to marshal excluded categories: %w", err)
+	}
+
+	deliveryTypes, err := json.Marshal(c.ApplicableDeliveryTypes)
+	if err != nil {
+		return fmt.Errorf("failed to marshal delivery types: %w", err)
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		UPDATE coupons SET
+			discount_type = $2,
+			discount_value = $3,
+			discount_target = $4,
+			min_order_value = $5,
+			max_usage_per_user = $6,
+			expiry_date = $7,
+			applicable_medicine_ids = $8,
+			applicable_categories = $9,
+			usage_type = $10,
+			valid_start = $11,
+			valid_end = $12,
+			terms_and_conditions = $13,
+			max_discount_amount = $14,
+			max_total_redemptions = $16,
+			max_total_discount_budget = $17,
+			min_eligible_units = $18,
+			buy_x_get_y = $19,
+			tiers = $20,
+			applicable_delivery_types = $21,
+			rounding_mode = $22,
+			rounding_unit = $23,
+			currency = $24,
+			allow_cross_currency = $25,
+			excluded_medicine_ids = $26,
+			excluded_categories = $27,
+			schedule = $28,
+			segment_rules = $29,
+			stacking_group = $30,
+			exclusive = $31,
+			precedence = $32,
+			version = version + 1
+		WHERE coupon_code = $1 AND version = $15
+		RETURNING version
+	`,
+		c.CouponCode,
+		c.DiscountType,
+		c.DiscountValue,
+		c.DiscountTarget,
+		c.MinOrderValue,
+		c.MaxUsagePerUser,
+		c.ExpiryDate,
+		meds,
+		cats,
+		c.UsageType,
+		c.ValidTimeWindow.Start,
+		c.ValidTimeWindow.End,
+		c.TermsAndConditions,
+		c.MaxDiscountAmount,
+		c.Version,
+		c.MaxTotalRedemptions,
+		c.MaxTotalDiscountBudget,
+		c.MinEligibleUnits,
+		bxgy,
+		tiers,
+		deliveryTypes,
+		c.RoundingMode,
+		c.RoundingUnit,
+		c.Currency,
+		c.AllowCrossCurrency,
+		excludedMeds,
+		excludedCats,
+		schedule,
+		segmentRules,
+		c.StackingGroup,
+		c.Exclusive,
+		c.Precedence,
+	).Scan(&c.Version)
+	if err == sql.ErrNoRows {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update coupon: %w", err)
+	}
+	return nil
 }
 
-func (r *CouponRepository) GetUserUsageCount(ctx context.Context, tx *sql.Tx, userID, couponCode string) (int, error) {
+// UpdateCouponStatus moves a coupon to status and bumps its version.
+func (r *CouponRepository) UpdateCouponStatus(ctx context.Context, tx *sql.Tx, code string, status models.CouponStatus) (int, error) {
+	var version int
+	err := tx.QueryRowContext(ctx, `
+		UPDATE coupons SET status = $2, version = version + 1
+		WHERE coupon_code = $1
+		RETURNING version
+	`, code, status).Scan(&version)
+	return version, err
+}
+
+func (r *CouponRepository) GetUserUsageCount(ctx context.Context, tx *sql.Tx, userID, couponCode string, now time.Time) (int, error) {
 	var count int
 	err := tx.QueryRowContext(ctx, `
 		SELECT COUNT(*) FROM coupon_usages
 		WHERE user_id = $1 AND coupon_code = $2
-	`, userID, couponCode).Scan(&count)
+		  AND (status = 'confirmed' OR (status = 'reserved' AND reserved_until > $3))
+	`, userID, couponCode, now).Scan(&count)
 	if err != nil {
 		return 0, err
 	}
 	return count, nil
 }
 
-func (r *CouponRepository) RecordUsage(ctx context.Context, tx *sql.Tx, userID, couponCode string, usedAt time.Time) error {
-	_, err := tx.ExecContext(ctx, `
-		INSERT INTO coupon_usages (user_id, coupon_code, used_at)
-		VALUES ($1, $2, $3)
-	`, userID, couponCode, usedAt)
-	return err
+// GetCouponUsageTotals returns how many times a coupon has been used across
+// all users and the discount those uses granted. Reservations that have not
+// lapsed by now are included so they cannot be oversold.
+func (r *CouponRepository) GetCouponUsageTotals(ctx context.Context, tx *sql.Tx, couponCode string, now time.Time) (int, models.Money, error) {
+	var count int
+	var discount models.Money
+	err := tx.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(discount_amount), 0) FROM coupon_usages
+		WHERE coupon_code = $1
+		  AND (status = 'confirmed' OR (status = 'reserved' AND reserved_until > $2))
+	`, couponCode, now).Scan(&count, &discount)
+	if err != nil {
+		return 0, 0, err
+	}
+	return count, discount, nil
 }
 
-func (r *CouponRepository) GetValidCoupons(ctx context.Context, currentTime time.Time) ([]models.Coupon, error) {
+// GetRedemptionStats returns usage totals for each of codes. Coupons with no
+// usage are absent from the map.
+func (r *CouponRepository) GetRedemptionStats(ctx context.Context, codes []string, now time.Time) (map[string]models.RedemptionStats, error) {
 	rows, err := r.DBHelper.PostgresClient.QueryContext(ctx, `
-		SELECT 
-			coupon_code, expiry_date, usage_type, 
-			applicable_medicine_ids, applicable_categories, 
-			min_order_value, valid_start, valid_end, 
-			terms_and_conditions, discount_type, discount_value, 
-			max_usage_per_user, discount_target, max_discount_amount
-		FROM coupons
-		WHERE expiry_date >= $1
-	`, currentTime)
+		SELECT coupon_code, COUNT(*), COALESCE(SUM(discount_amount), 0) FROM coupon_usages
+		WHERE coupon_code = ANY($1)
+		  AND (status = 'confirmed' OR (status = 'reserved' AND reserved_until > $2))
+		GROUP BY coupon_code
+	`, pq.Array(codes), now)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var coupons []models.Coupon
+	stats := make(map[string]models.RedemptionStats)
+	for rows.Next() {
+		var code string
+		var st models.RedemptionStats
+		if err := rows.Scan(&code, &st.TotalRedemptions, &st.TotalDiscountGiven); err != nil {
+			return nil, err
+		}
+		stats[code] = st
+	}
+	return stats, rows.Err()
+}
+
+// GetUserUsageCounts returns how many live uses userID holds of each of codes.
+// Coupons the user has never used are absent from the map.
+func (r *CouponRepository) GetUserUsageCounts(ctx context.Context, userID string, codes []string, now time.Time) (map[string]int, error) {
+	rows, err := r.DBHelper.PostgresClient.QueryContext(ctx, `
+		SELECT coupon_code, COUNT(*) FROM coupon_usages
+		WHERE user_id = $1 AND coupon_code = ANY($2)
+		  AND (status = 'confirmed' OR (status = 'reserved' AND reserved_until > $3))
+		GROUP BY coupon_code
+	`, userID, pq.Array(codes), now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
+	counts := make(map[string]int)
 	for rows.Next() {
-		var c models.Coupon
-		var meds, cats []byte
-
-		err := rows.Scan(
-			&c.CouponCode, &c.ExpiryDate, &c.UsageType,
-			&meds, &cats,
-			&c.MinOrderValue, &c.ValidTimeWindow.Start, &c.ValidTimeWindow.End,
-			&c.TermsAndConditions, &c.DiscountType, &c.DiscountValue,
-			&c.MaxUsagePerUser, &c.DiscountTarget, &c.MaxDiscountAmount,
-		)
-		if err != nil {
+		var code string
+		var count int
+		if err := rows.Scan(&code, &count); err != nil {
 			return nil, err
 		}
+		counts[code] = count
+	}
+	return counts, rows.Err()
+}
 
-		if err := json.Unmarshal(meds, &c.ApplicableMedicineIDs); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal medicine IDs: %w", err)
+// GetOrderDiscounts returns the discount each coupon already grants orderID,
+// counting confirmed uses and reservations that have not lapsed by now.
+// Amounts are in each coupon's own currency.
+func (r *CouponRepository) GetOrderDiscounts(ctx context.Context, tx *sql.Tx, orderID string, now time.Time) (map[string]models.Money, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT coupon_code, COALESCE(SUM(discount_amount), 0) FROM coupon_usages
+		WHERE order_id = $1
+		  AND (status = 'confirmed' OR (status = 'reserved' AND reserved_until > $2))
+		GROUP BY coupon_code
+	`, orderID, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	discounts := make(map[string]models.Money)
+	for rows.Next() {
+		var code string
+		var discount models.Money
+		if err := rows.Scan(&code, &discount); err != nil {
+			return nil, err
 		}
-		if err := json.Unmarshal(cats, &c.ApplicableCategories); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal categories: %w", err)
+		discounts[code] = discount
+	}
+	return discounts, rows.Err()
+}
+
+// RecordUsage stores a confirmed redemption and returns its usage ID.
+func (r *CouponRepository) RecordUsage(ctx context.Context, tx *sql.Tx, userID, couponCode, orderID string, discount models.Money, usedAt time.Time) (int64, error) {
+	var id int64
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO coupon_usages (user_id, coupon_code, used_at, order_id, discount_amount)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5)
+		RETURNING id
+	`, userID, couponCode, usedAt, orderID, discount).Scan(&id)
+	return id, err
+}
+
+// ReserveUsage holds one use of a coupon for userID until reservedUntil and
+// returns the reservation ID. orderID may be empty until the reservation is
+// confirmed.
+func (r *CouponRepository) ReserveUsage(ctx context.Context, tx *sql.Tx, userID, couponCode, orderID string, discount models.Money, reservedAt, reservedUntil time.Time) (int64, error) {
+	var id int64
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO coupon_usages (user_id, coupon_code, used_at, status, reserved_until, order_id, discount_amount)
+		VALUES ($1, $2, $3, 'reserved', $4, NULLIF($5, ''), $6)
+		RETURNING id
+	`, userID, couponCode, reservedAt, reservedUntil, orderID, discount).Scan(&id)
+	return id, err
+}
+
+// FlagClockSkew marks a usage whose client timestamp was too far from server
+// time to be trusted, keeping the timestamp the client sent for audit.
+func (r *CouponRepository) FlagClockSkew(ctx context.Context, tx *sql.Tx, usageID int64, clientTimestamp time.Time) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE coupon_usages SET clock_skew = TRUE, client_timestamp = $2 WHERE id = $1
+	`, usageID, clientTimestamp)
+	return err
+}
+
+const usageColumns = `id, user_id, coupon_code, status, order_id, used_at, reserved_until`
+
+func scanUsage(row rowScanner) (models.CouponUsage, error) {
+	var u models.CouponUsage
+	var orderID sql.NullString
+	var reservedUntil sql.NullTime
+
+	err := row.Scan(&u.ID, &u.UserID, &u.CouponCode, &u.Status, &orderID, &u.UsedAt, &reservedUntil)
+	if err != nil {
+		return u, err
+	}
+
+	u.OrderID = orderID.String
+	if reservedUntil.Valid {
+		u.ReservedUntil = &reservedUntil.Time
+	}
+	return u, nil
+}
+
+// GetUsage loads a usage row and locks it for the rest of tx.
+func (r *CouponRepository) GetUsage(ctx context.Context, tx *sql.Tx, id int64) (models.CouponUsage, error) {
+	return scanUsage(tx.QueryRowContext(ctx, `
+		SELECT `+usageColumns+`
+		FROM coupon_usages
+		WHERE id = $1
+		FOR UPDATE
+	`, id))
+}
+
+// GetUsagesByOrder loads and locks every usage attached to orderID.
+func (r *CouponRepository) GetUsagesByOrder(ctx context.Context, tx *sql.Tx, orderID string) ([]models.CouponUsage, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT `+usageColumns+`
+		FROM coupon_usages
+		WHERE order_id = $1
+		ORDER BY id
+		FOR UPDATE
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usages []models.CouponUsage
+	for rows.Next() {
+		u, err := scanUsage(rows)
+		if err != nil {
+			return nil, err
 		}
+		usages = append(usages, u)
+	}
+	return usages, rows.Err()
+}
 
-		coupons = append(coupons, c)
+// RecordReversal writes the audit entry for a reversed usage.
+func (r *CouponRepository) RecordReversal(ctx context.Context, tx *sql.Tx, usageID int64, orderID, reason string) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO coupon_usage_reversals (usage_id, order_id, reason)
+		VALUES ($1, NULLIF($2, ''), $3)
+	`, usageID, orderID, reason)
+	return err
+}
+
+// SetUsageStatus moves a usage row to status, attaching orderID when it is not empty.
+func (r *CouponRepository) SetUsageStatus(ctx context.Context, tx *sql.Tx, id int64, status models.UsageStatus, orderID string) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE coupon_usages
+		SET status = $2, order_id = COALESCE(NULLIF($3, ''), order_id)
+		WHERE id = $1
+	`, id, status, orderID)
+	return err
+}
+
+// ExpireReservations marks every reservation whose deadline is at or before
+// now as expired and returns how many rows were affected.
+func (r *CouponRepository) ExpireReservations(ctx context.Context, now time.Time) (int64, error) {
+	res, err := r.DBHelper.PostgresClient.ExecContext(ctx, `
+		UPDATE coupon_usages
+		SET status = 'expired'
+		WHERE status = 'reserved' AND reserved_until <= $1
+	`, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetIdempotentResponse loads what was stored for key: the operation it was
+// used for, and the user and coupon the response was issued to. resp is only
+// filled in when the key was stored for operation, since a response of another
+// kind would not fit it.
+func (r *CouponRepository) GetIdempotentResponse(ctx context.Context, tx *sql.Tx, key, operation string, resp any) (storedOperation, userID, couponCode string, err error) {
+	var raw []byte
+	err = tx.QueryRowContext(ctx, `
+		SELECT operation, user_id, coupon_code, response
+		FROM coupon_idempotency_keys
+		WHERE idempotency_key = $1
+	`, key).Scan(&storedOperation, &userID, &couponCode, &raw)
+	if err != nil || storedOperation != operation {
+		return storedOperation, userID, couponCode, err
 	}
 
-	return coupons, nil
+	if err := json.Unmarshal(raw, resp); err != nil {
+		return storedOperation, userID, couponCode, fmt.Errorf("failed to unmarshal stored response: %w", err)
+	}
+	return storedOperation, userID, couponCode, nil
+}
+
+// SaveIdempotentResponse stores resp under key for operation. ErrDuplicateKey
+// means another request with the same key got there first.
+func (r *CouponRepository) SaveIdempotentResponse(ctx context.Context, tx *sql.Tx, key, operation, userID, couponCode string, resp any) error {
+	raw, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO coupon_idempotency_keys (idempotency_key, operation, user_id, coupon_code, response)
+		VALUES ($1, $2, $3, $4, $5)
+	`, key, operation, userID, couponCode, raw)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrDuplicateKey
+	}
+	return err
+}
+
+// GetStackIdempotentResponse loads the stacked redemption response stored for
+// key, along with the user and coupon codes it was issued for.
+func (r *CouponRepository) GetStackIdempotentResponse(ctx context.Context, tx *sql.Tx, key string) (userID string, couponCodes []string, resp models.StackCouponsResponse, err error) {
+	var rawCodes, raw []byte
+	err = tx.QueryRowContext(ctx, `
+		SELECT user_id, coupon_codes, response
+		FROM coupon_stack_idempotency_keys
+		WHERE idempotency_key = $1
+	`, key).Scan(&userID, &rawCodes, &raw)
+	if err != nil {
+		return userID, couponCodes, resp, err
+	}
+
+	if err := json.Unmarshal(rawCodes, &couponCodes); err != nil {
+		return userID, couponCodes, resp, fmt.Errorf("failed to unmarshal stored coupon codes: %w", err)
+	}
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return userID, couponCodes, resp, fmt.Errorf("failed to unmarshal stored response: %w", err)
+	}
+	return userID, couponCodes, resp, nil
+}
+
+// SaveStackIdempotentResponse stores resp under key. ErrDuplicateKey means
+// another request with the same key got there first.
+func (r *CouponRepository) SaveStackIdempotentResponse(ctx context.Context, tx *sql.Tx, key, userID string, couponCodes []string, resp models.StackCouponsResponse) error {
+	rawCodes, err := json.Marshal(couponCodes)
+	if err != nil {
+		return fmt.Errorf("failed to marshal coupon codes: %w", err)
+	}
+	raw, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO coupon_stack_idempotency_keys (idempotency_key, user_id, coupon_codes, response)
+		VALUES ($1, $2, $3, $4)
+	`, key, userID, rawCodes, raw)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrDuplicateKey
+	}
+	return err
+}
+
+func (r *CouponRepository) GetValidCoupons(ctx context.Context, currentTime time.Time) ([]models.Coupon, error) {
+	rows, err := r.DBHelper.PostgresClient.QueryContext(ctx, `
+		SELECT `+couponColumns+`
+		FROM coupons
+		WHERE expiry_date >= $1 AND status IN ('active', 'scheduled')
+	`, currentTime)
+	if err != nil {
+		return nil, err
+	}
+	return scanCoupons(rows)
 }
@@ -0,0 +1,69 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Puneet-Vishnoi/Coupon-System/db/postgres/providers"
+	"github.com/Puneet-Vishnoi/Coupon-System/models"
+)
+
+// UserProfileRepository reads customer facts from the user_profiles table,
+// which is kept up to date by the order pipeline.
+type UserProfileRepository struct {
+	DBHelper *providers.DBHelper
+}
+
+func NewUserProfileRepository(db *providers.DBHelper) *UserProfileRepository {
+	return &UserProfileRepository{DBHelper: db}
+}
+
+// GetUserProfile returns the profile for userID, or an empty profile if the
+// user has never ordered.
+func (r *UserProfileRepository) GetUserProfile(ctx context.Context, userID string) (models.UserProfile, error) {
+	p := models.UserProfile{UserID: userID}
+	var lastOrderAt sql.NullTime
+	var segments []byte
+
+	err := r.DBHelper.PostgresClient.QueryRowContext(ctx, `
+		SELECT order_count, last_order_at, segments FROM user_profiles WHERE user_id = $1
+	`, userID).Scan(&p.OrderCount, &lastOrderAt, &segments)
+	if err == sql.ErrNoRows {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+
+	if lastOrderAt.Valid {
+		p.LastOrderAt = &lastOrderAt.Time
+	}
+	if err := json.Unmarshal(segments, &p.Segments); err != nil {
+		return p, fmt.Errorf("failed to unmarshal segments: %w", err)
+	}
+	return p, nil
+}
+
+// SaveUserProfile inserts or replaces the profile for p.UserID.
+func (r *UserProfileRepository) SaveUserProfile(ctx context.Context, p models.UserProfile) error {
+	segments, err := json.Marshal(p.Segments)
+	if err != nil {
+		return fmt.Errorf("failed to marshal segments: %w", err)
+	}
+
+	_, err = r.DBHelper.PostgresClient.ExecContext(ctx, `
+		INSERT INTO user_profiles (user_id, order_count, last_order_at, segments, updated_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (user_id) DO UPDATE SET
+			order_count = EXCLUDED.order_count,
+			last_order_at = EXCLUDED.last_order_at,
+			segments = EXCLUDED.segments,
+			updated_at = NOW()
+	`, p.UserID, p.OrderCount, p.LastOrderAt, segments)
+	if err != nil {
+		return fmt.Errorf("failed to save user profile: %w", err)
+	}
+	return nil
+}
@@ -16,7 +16,24 @@ func RegisterRoutes(router *gin.Engine, service *service.CouponService) {
 	api := router.Group("/api")
 	{
 		api.POST("/coupons", couponHandler.CreateCoupon)
+		api.GET("/coupons", couponHandler.ListCoupons)
+		api.GET("/coupons/:code", couponHandler.GetCoupon)
+		api.PUT("/coupons/:code", couponHandler.UpdateCoupon)
+		api.PATCH("/coupons/:code", couponHandler.PatchCoupon)
+		api.POST("/coupons/:code/status", couponHandler.SetCouponStatus)
+		api.POST("/coupons/:code/pause", couponHandler.PauseCoupon)
+		api.POST("/coupons/:code/resume", couponHandler.ResumeCoupon)
+		api.POST("/coupons/:code/archive", couponHandler.ArchiveCoupon)
 		api.POST("/coupons/applicable", couponHandler.GetApplicableCoupons)
+		api.POST("/coupons/best", couponHandler.BestCoupons)
 		api.POST("/coupons/validate", couponHandler.ValidateCoupon)
+		api.POST("/coupons/redeem", couponHandler.ValidateCoupon)
+		api.POST("/coupons/quote", couponHandler.QuoteCoupon)
+		api.POST("/coupons/stack/quote", couponHandler.QuoteStack)
+		api.POST("/coupons/stack/redeem", couponHandler.RedeemStack)
+		api.POST("/coupons/reserve", couponHandler.ReserveCoupon)
+		api.POST("/coupons/reservations/:id/confirm", couponHandler.ConfirmReservation)
+		api.POST("/coupons/reservations/:id/release", couponHandler.ReleaseReservation)
+		api.POST("/coupons/reversals", couponHandler.ReverseUsage)
 	}
 }
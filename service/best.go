@@ -0,0 +1,111 @@
+package service
+
+import (
+	"context"
+	"sort"
+
+	"github.com/Puneet-Vishnoi/Coupon-System/models"
+)
+
+// maxStackOptions bounds how many coupon combinations BestCoupons prices, so
+// a cart that qualifies for many stackable coupons stays cheap to answer. The
+// response is marked truncated when the bound is hit.
+const maxStackOptions = 1000
+
+// BestCoupons prices every coupon the cart qualifies for, alone and in every
+// combination the stacking rules allow, and ranks them by savings. The first
+// option is flagged as recommended. Coupons are filtered by the same rules as
+// the applicable list, per-user limits included when req names a user, and
+// each is priced within what is left of its budget.
+func (s *CouponService) BestCoupons(ctx context.Context, req models.ApplicableCouponsRequest) (models.BestCouponsResponse, error) {
+	req.Timestamp, _ = s.requestTime(req.Timestamp)
+	currency := currencyOf(req.Currency)
+	resp := models.BestCouponsResponse{Currency: currency, Options: []models.CouponOption{}}
+
+	coupons, _, err := s.applicableCoupons(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	sort.SliceStable(coupons, func(i, j int) bool {
+		if coupons[i].Precedence != coupons[j].Precedence {
+			return coupons[i].Precedence < coupons[j].Precedence
+		}
+		return coupons[i].CouponCode < coupons[j].CouponCode
+	})
+
+	var priced []stackEntry
+	for _, c := range coupons {
+		discount := previewDiscount(c, req)
+		if discount.total() > 0 {
+			priced = append(priced, stackEntry{code: c.CouponCode, coupon: c, discount: discount})
+		}
+	}
+
+	// Walk every subset in precedence order, skipping any that break the
+	// stacking rules; supersets of a conflicting subset conflict too, so no
+	// stack holds two coupons of one group.
+	evaluated := 0
+	var walk func(start int, picked []*stackEntry)
+	walk = func(start int, picked []*stackEntry) {
+		for i := start; i < len(priced) && !resp.Truncated; i++ {
+			if stackConflict(priced[i].coupon, picked) != nil {
+				continue
+			}
+			if evaluated == maxStackOptions {
+				resp.Truncated = true
+				return
+			}
+			next := append(picked[:len(picked):len(picked)], &priced[i])
+			evaluated++
+			if option, ok := s.stackOption(next, req, currency); ok {
+				resp.Options = append(resp.Options, option)
+			}
+			walk(i+1, next)
+		}
+	}
+	walk(0, nil)
+
+	// Ties go to the option with fewer coupons, leaving the rest for later orders.
+	sort.SliceStable(resp.Options, func(i, j int) bool {
+		a, b := resp.Options[i], resp.Options[j]
+		if a.TotalDiscount != b.TotalDiscount {
+			return a.TotalDiscount > b.TotalDiscount
+		}
+		return len(a.CouponCodes) < len(b.CouponCodes)
+	})
+	if len(resp.Options) > 0 {
+		resp.Options[0].Recommended = true
+	}
+	return resp, nil
+}
+
+// stackOption prices picked, which is in precedence order, as one stack. It
+// reports false when the combined cap leaves a coupon with nothing to give,
+// since the same stack without that coupon is already an option.
+func (s *CouponService) stackOption(picked []*stackEntry, req models.ApplicableCouponsRequest, currency string) (models.CouponOption, bool) {
+	entries := make([]stackEntry, len(picked))
+	ptrs := make([]*stackEntry, len(picked))
+	for i, p := range picked {
+		entries[i] = stackEntry{code: p.code, coupon: p.coupon, discount: p.discount.clone()}
+		ptrs[i] = &entries[i]
+	}
+	// The caps apply to one coupon as they do to several, matching what
+	// the stack redeem endpoint gives.
+	s.combineStack(nil, ptrs, req.OrderTotal, req.DeliveryFee)
+
+	codes := make([]string, len(entries))
+	for i, e := range entries {
+		if e.err != nil {
+			return models.CouponOption{}, false
+		}
+		codes[i] = e.code
+	}
+
+	stack := stackResponse(entries, currency, nil)
+	return models.CouponOption{
+		CouponCodes:   codes,
+		Discount:      stack.Discount,
+		TotalDiscount: stack.TotalDiscount,
+		Coupons:       stack.Coupons,
+	}, true
+}
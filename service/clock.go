@@ -0,0 +1,46 @@
+package service
+
+import (
+	"log"
+	"time"
+)
+
+// defaultClockSkew is how far a client timestamp may drift from the server
+// clock before it is ignored.
+const defaultClockSkew = 5 * time.Minute
+
+// Clock tells the service what time it is. Tests swap in a FixedClock.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock reads the host clock.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time { return time.Now() }
+
+// FixedClock always reports the same instant.
+type FixedClock struct {
+	Time time.Time
+}
+
+func (c FixedClock) Now() time.Time { return c.Time }
+
+// requestTime decides which instant a request is judged at. The server clock
+// is authoritative: a client timestamp is honoured only while it is within
+// MaxClockSkew of it, and skewed reports when it was not.
+func (s *CouponService) requestTime(client time.Time) (at time.Time, skewed bool) {
+	now := s.Clock.Now()
+	if client.IsZero() {
+		return now, false
+	}
+	drift := client.Sub(now)
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift > s.MaxClockSkew {
+		log.Printf("client timestamp %s is %s away from server time, using server time", client.Format(time.RFC3339), drift)
+		return now, true
+	}
+	return client, false
+}
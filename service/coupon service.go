@@ -3,8 +3,10 @@ package service
 import (
 	"context"
 	"database/sql"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	redisProvider "github.com/Puneet-Vishnoi/Coupon-System/cache/redis/providers"
@@ -12,16 +14,86 @@ import (
 	"github.com/Puneet-Vishnoi/Coupon-System/repository"
 )
 
+const defaultPageSize = 20
+
+var (
+	ErrCouponNotFound    = newError(KindNotFound, "COUPON_NOT_FOUND", "coupon not found")
+	ErrCouponExists      = newError(KindConflict, "COUPON_EXISTS", "coupon already exists")
+	ErrInvalidCursor     = newError(KindInvalid, "INVALID_CURSOR", "invalid cursor")
+	ErrVersionConflict   = newError(KindConflict, "VERSION_CONFLICT", "coupon was modified by another request")
+	ErrConcurrentUpdate  = newError(KindConflict, "CONCURRENT_UPDATE", "request raced another request for the same coupon, retry it")
+	ErrInvalidTransition = newError(KindConflict, "INVALID_STATUS_TRANSITION", "invalid coupon status transition")
+	ErrCouponArchived    = newError(KindConflict, "COUPON_ARCHIVED", "archived coupons cannot be changed")
+	ErrCouponInactive    = newError(KindRejected, "COUPON_INACTIVE", "coupon is not active")
+
+	ErrCouponExpired     = newError(KindRejected, "COUPON_EXPIRED", "coupon expired")
+	ErrOutsideTimeWindow = newError(KindRejected, "OUTSIDE_TIME_WINDOW", "coupon not valid at this time")
+	ErrUsageLimitReached = newError(KindRejected, "USAGE_LIMIT_REACHED", "usage limit reached")
+	ErrNoEligibleItems   = newError(KindRejected, "NO_ELIGIBLE_ITEMS", "coupon not applicable to cart items")
+	ErrBelowMinOrder     = newError(KindRejected, "MIN_ORDER_NOT_MET", "order total does not meet minimum requirement")
+
+	ErrCouponAlreadyRedeemed = newError(KindRejected, "COUPON_ALREADY_REDEEMED", "coupon has already been redeemed")
+	ErrRedemptionCapReached  = newError(KindRejected, "REDEMPTION_LIMIT_REACHED", "coupon redemption limit reached")
+	ErrBudgetExhausted       = newError(KindRejected, "BUDGET_EXHAUSTED", "coupon discount budget exhausted")
+	ErrNotEnoughUnits        = newError(KindRejected, "NOT_ENOUGH_UNITS", "cart does not contain enough eligible units")
+	ErrDeliveryNotApplicable = newError(KindRejected, "DELIVERY_NOT_APPLICABLE", "coupon does not apply to this delivery")
+
+	ErrIdempotencyKeyReused = newError(KindRejected, "IDEMPOTENCY_KEY_REUSED", "idempotency key was already used for a different request")
+	ErrIdempotencyInFlight  = newError(KindConflict, "IDEMPOTENCY_IN_FLIGHT", "a request with this idempotency key is already in progress")
+)
+
+// allowedTransitions lists, for every lifecycle state, the states a coupon may
+// move to next. Archived is terminal.
+var allowedTransitions = map[models.CouponStatus][]models.CouponStatus{
+	models.CouponStatusDraft:     {models.CouponStatusScheduled, models.CouponStatusActive, models.CouponStatusArchived},
+	models.CouponStatusScheduled: {models.CouponStatusDraft, models.CouponStatusActive, models.CouponStatusPaused, models.CouponStatusArchived},
+	models.CouponStatusActive:    {models.CouponStatusPaused, models.CouponStatusArchived},
+	models.CouponStatusPaused:    {models.CouponStatusActive, models.CouponStatusArchived},
+	models.CouponStatusArchived:  {},
+}
+
 type CouponService struct {
 	Repo        *repository.CouponRepository
 	RedisHelper *redisProvider.RedisHelper
+	Rates       ExchangeRateProvider // used only by coupons that allow cross-currency orders
+
+	// Clock is the authoritative time for every check. Client timestamps
+	// further than MaxClockSkew from it are ignored and flagged.
+	Clock        Clock
+	MaxClockSkew time.Duration
+
+	// Profiles resolves the customer facts that segment rules are judged on.
+	Profiles UserProfileProvider
+
+	// MaxCombinedDiscountPercent caps what stacked coupons may take off an
+	// order together, as a percentage of the order total. 0 leaves only the
+	// order value itself as the cap.
+	MaxCombinedDiscountPercent models.Money
 }
 
 func NewCouponService(repo *repository.CouponRepository, redis *redisProvider.RedisHelper) *CouponService {
-	return &CouponService{Repo: repo, RedisHelper: redis}
+	return &CouponService{
+		Repo:         repo,
+		RedisHelper:  redis,
+		Clock:        SystemClock{},
+		MaxClockSkew: defaultClockSkew,
+		Profiles:     repository.NewUserProfileRepository(repo.DBHelper),
+	}
 }
 
 func (s *CouponService) CreateCoupon(ctx context.Context, coupon *models.Coupon) (err error) {
+	switch coupon.Status {
+	case "":
+		coupon.Status = models.CouponStatusActive
+	case models.CouponStatusDraft, models.CouponStatusScheduled, models.CouponStatusActive:
+	default:
+		return fmt.Errorf("%w: a new coupon cannot start as %s", ErrInvalidCoupon, coupon.Status)
+	}
+
+	if err := validateCouponRules(coupon); err != nil {
+		return err
+	}
+
 	tx, err := s.Repo.DBHelper.PostgresClient.BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
@@ -37,7 +109,7 @@ func (s *CouponService) CreateCoupon(ctx context.Context, coupon *models.Coupon)
 
 	c, err := s.Repo.GetCouponByCode(ctx, tx, coupon.CouponCode)
 	if err == nil && c.CouponCode == coupon.CouponCode {
-		return errors.New("coupon already exists")
+		return ErrCouponExists
 	}
 	if err != nil && err != sql.ErrNoRows {
 		return err
@@ -57,44 +129,333 @@ func (s *CouponService) CreateCoupon(ctx context.Context, coupon *models.Coupon)
 	return nil
 }
 
-func (s *CouponService) GetApplicableCoupons(ctx context.Context, req models.ApplicableCouponsRequest) ([]models.Coupon, error) {
+// UpdateCoupon replaces the stored coupon with coupon, provided coupon.Version
+// still matches what is stored and the coupon is not archived. On success
+// coupon.Version holds the new version.
+func (s *CouponService) UpdateCoupon(ctx context.Context, coupon *models.Coupon) (err error) {
+	if err := validateCouponRules(coupon); err != nil {
+		return err
+	}
+
+	tx, err := s.Repo.DBHelper.PostgresClient.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	current, err := s.fetchCouponFromDB(ctx, tx, coupon.CouponCode)
+	if err != nil {
+		return err
+	}
+	if current.Version != coupon.Version {
+		return ErrVersionConflict
+	}
+	if current.Status == models.CouponStatusArchived {
+		return ErrCouponArchived
+	}
+	// Status only changes through TransitionCoupon.
+	coupon.Status = current.Status
+
+	err = s.Repo.UpdateCoupon(ctx, tx, coupon)
+	if err == sql.ErrNoRows {
+		return ErrVersionConflict
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.RedisHelper.Delete(ctx, "valid_coupons")
+	return nil
+}
+
+// TransitionCoupon moves a coupon to another lifecycle state if
+// allowedTransitions permits it, and returns the updated coupon.
+func (s *CouponService) TransitionCoupon(ctx context.Context, code string, to models.CouponStatus) (coupon models.Coupon, err error) {
+	tx, err := s.Repo.DBHelper.PostgresClient.BeginTx(ctx, nil)
+	if err != nil {
+		return coupon, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	coupon, err = s.fetchCouponFromDB(ctx, tx, code)
+	if err != nil {
+		return coupon, err
+	}
+
+	if !canTransition(coupon.Status, to) {
+		return coupon, fmt.Errorf("%w: %s to %s", ErrInvalidTransition, coupon.Status, to)
+	}
+
+	coupon.Version, err = s.Repo.UpdateCouponStatus(ctx, tx, code, to)
+	if err != nil {
+		return coupon, err
+	}
+	coupon.Status = to
+
+	if err := tx.Commit(); err != nil {
+		return coupon, err
+	}
+
+	s.RedisHelper.Delete(ctx, "valid_coupons")
+	return coupon, nil
+}
+
+func (s *CouponService) GetCoupon(ctx context.Context, code string) (models.Coupon, error) {
+	coupon, err := s.Repo.FindCouponByCode(ctx, code)
+	if err == sql.ErrNoRows {
+		return coupon, ErrCouponNotFound
+	}
+	if err != nil {
+		return coupon, err
+	}
+
+	coupons := []models.Coupon{coupon}
+	if err := s.attachRedemptionStats(ctx, coupons); err != nil {
+		return coupon, err
+	}
+	return coupons[0], nil
+}
+
+// ListCoupons returns one page of coupons matching req. The cursor handed back
+// in NextCursor is opaque to clients; it encodes the last coupon code served.
+func (s *CouponService) ListCoupons(ctx context.Context, req models.ListCouponsRequest) (models.CouponListResponse, error) {
+	var resp models.CouponListResponse
+
+	after, err := decodeCursor(req.Cursor)
+	if err != nil {
+		return resp, err
+	}
+
+	limit := req.Limit
+	if limit == 0 {
+		limit = defaultPageSize
+	}
+
+	// Fetch one extra row so we know whether another page exists.
+	coupons, err := s.Repo.GetAllCoupons(ctx, repository.CouponFilter{
+		DiscountType:   req.DiscountType,
+		DiscountTarget: req.DiscountTarget,
+		Status:         req.Status,
+		Category:       req.Category,
+		MedicineID:     req.MedicineID,
+		Expired:        req.Expired,
+		ExpiresAfter:   req.ExpiresAfter,
+		ExpiresBefore:  req.ExpiresBefore,
+		AfterCode:      after,
+		Limit:          limit + 1,
+		Now:            s.Clock.Now(),
+	})
+	if err != nil {
+		return resp, err
+	}
+
+	if len(coupons) > limit {
+		coupons = coupons[:limit]
+		resp.NextCursor = encodeCursor(coupons[limit-1].CouponCode)
+	}
+	if coupons == nil {
+		coupons = []models.Coupon{}
+	}
+	if err := s.attachRedemptionStats(ctx, coupons); err != nil {
+		return resp, err
+	}
+	resp.Coupons = coupons
+	return resp, nil
+}
+
+// attachRedemptionStats fills in Redemptions on every coupon, including how
+// much of each global cap is left.
+func (s *CouponService) attachRedemptionStats(ctx context.Context, coupons []models.Coupon) error {
+	if len(coupons) == 0 {
+		return nil
+	}
+
+	codes := make([]string, len(coupons))
+	for i, c := range coupons {
+		codes[i] = c.CouponCode
+	}
+
+	stats, err := s.Repo.GetRedemptionStats(ctx, codes, s.Clock.Now())
+	if err != nil {
+		return err
+	}
+
+	for i := range coupons {
+		c := &coupons[i]
+		st := stats[c.CouponCode]
+		if c.MaxTotalRedemptions > 0 {
+			remaining := max(c.MaxTotalRedemptions-st.TotalRedemptions, 0)
+			st.RemainingRedemptions = &remaining
+		}
+		if c.MaxTotalDiscountBudget > 0 {
+			remaining := max(c.MaxTotalDiscountBudget-st.TotalDiscountGiven, 0)
+			st.RemainingDiscountBudget = &remaining
+		}
+		c.Redemptions = &st
+	}
+	return nil
+}
+
+// GetApplicableCoupons prices every live coupon the cart qualifies for and
+// explains, with a reason code, why each of the others was left out. Coupons
+// the caller could never be offered, such as another segment's or a spent
+// single-use code, are not listed at all.
+func (s *CouponService) GetApplicableCoupons(ctx context.Context, req models.ApplicableCouponsRequest) (models.ApplicableCouponsResponse, error) {
+	req.Timestamp, _ = s.requestTime(req.Timestamp)
+	resp := models.ApplicableCouponsResponse{
+		Currency:   currencyOf(req.Currency),
+		Applicable: []models.ApplicableCoupon{},
+		Ineligible: []models.IneligibleCoupon{},
+	}
+
+	coupons, ineligible, err := s.applicableCoupons(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	resp.Ineligible = append(resp.Ineligible, ineligible...)
+
+	for _, c := range coupons {
+		discount := previewDiscount(c, req)
+		applicable := models.ApplicableCoupon{
+			CouponSummary: summarize(c),
+			Discount:      discount.Amounts,
+			TotalDiscount: discount.total(),
+			NextTier:      nextTier(c, req.OrderTotal),
+			Redemptions:   c.Redemptions,
+		}
+		if c.MaxDiscountAmount > 0 {
+			headroom := max(c.MaxDiscountAmount-applicable.TotalDiscount, 0)
+			applicable.Headroom = &headroom
+		}
+		resp.Applicable = append(resp.Applicable, applicable)
+	}
+	sort.SliceStable(resp.Applicable, func(i, j int) bool {
+		return resp.Applicable[i].TotalDiscount > resp.Applicable[j].TotalDiscount
+	})
+
+	return resp, nil
+}
+
+// previewDiscount prices c, as returned by applicableCoupons, against the cart
+// in req the way redeeming it would, remaining budget included.
+func previewDiscount(c models.Coupon, req models.ApplicableCouponsRequest) discountResult {
+	discount := calculateDiscount(c, req.CartItems, req.OrderTotal, req.DeliveryFee)
+	if c.Redemptions != nil {
+		capToBudget(c, discount, c.Redemptions.TotalDiscountGiven)
+	}
+	return discount
+}
+
+// applicableCoupons sorts the live coupons into those the cart in req
+// qualifies for, with their amounts restated in the order currency, and
+// those it does not, leaving out any the caller could never be offered.
+// req.Timestamp must already be resolved.
+func (s *CouponService) applicableCoupons(ctx context.Context, req models.ApplicableCouponsRequest) ([]models.Coupon, []models.IneligibleCoupon, error) {
 	var allCoupons []models.Coupon
 	cacheHit, err := s.RedisHelper.GetJSON(ctx, "valid_coupons", &allCoupons)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if !cacheHit {
 		allCoupons, err = s.Repo.GetValidCoupons(ctx, req.Timestamp)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		s.RedisHelper.SetJSON(ctx, "valid_coupons", allCoupons, 10*time.Minute)
 	}
+	// Usage moves faster than the cache, so the counts are always read fresh.
+	if err := s.attachRedemptionStats(ctx, allCoupons); err != nil {
+		return nil, nil, err
+	}
 
+	var userUses map[string]int
+	var profile *models.UserProfile
+	if req.UserID != "" {
+		codes := make([]string, len(allCoupons))
+		for i, c := range allCoupons {
+			codes[i] = c.CouponCode
+		}
+		if userUses, err = s.Repo.GetUserUsageCounts(ctx, req.UserID, codes, s.Clock.Now()); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	currency := currencyOf(req.Currency)
 	var applicable []models.Coupon
+	var ineligible []models.IneligibleCoupon
 	for _, c := range allCoupons {
-		if req.OrderTotal < c.MinOrderValue {
+		// A targeted coupon can only be offered once the caller is known to
+		// be in its segment.
+		if req.UserID == "" && c.SegmentRules != nil {
 			continue
 		}
-
-		if len(c.ApplicableMedicineIDs) == 0 && len(c.ApplicableCategories) == 0 {
+		err := s.applicableCoupon(ctx, &c, req, currency, userUses, &profile)
+		if err == nil {
 			applicable = append(applicable, c)
 			continue
 		}
+		reason, ok := ineligibleReason(err)
+		if !ok {
+			return nil, nil, err
+		}
+		if withheld(reason) {
+			continue
+		}
 
-		for _, item := range req.CartItems {
-			if (len(c.ApplicableMedicineIDs) > 0 && contains(c.ApplicableMedicineIDs, item.ID)) ||
-				(len(c.ApplicableCategories) > 0 && contains(c.ApplicableCategories, item.Category)) {
-				applicable = append(applicable, c)
-				break
-			}
+		miss := notApplicable(c, reason, err)
+		switch reason {
+		case models.IneligibleNotEnoughUnits:
+			miss.UnitsNeeded = requiredUnits(c) - eligibleUnits(c, req.CartItems)
+		case models.IneligibleBelowMinOrder:
+			needed := c.MinOrderValue - req.OrderTotal
+			miss.AmountNeeded = &needed
 		}
+		ineligible = append(ineligible, miss)
 	}
 
-	return applicable, nil
+	return applicable, ineligible, nil
 }
 
-func (s *CouponService) ValidateCoupon(ctx context.Context, req models.ValidateCouponRequest) (resp models.ValidateCouponResponse, err error) {
+// ValidateCoupon is the redeem step: it runs every eligibility check and, if
+// they pass, records a usage against the user's quota.
+func (s *CouponService) ValidateCoupon(ctx context.Context, req models.ValidateCouponRequest) (models.ValidateCouponResponse, error) {
+	resp, err := s.validateCoupon(ctx, req)
+	if req.IdempotencyKey != "" && lostIdempotencyRace(err) {
+		var stored models.ValidateCouponResponse
+		found, replayErr := s.replayCommitted(ctx, req.IdempotencyKey, idempotencyValidate, req.UserID, req.CouponCode, &stored)
+		if found {
+			return stored, nil
+		}
+		if errors.Is(replayErr, ErrIdempotencyKeyReused) {
+			return resp, replayErr
+		}
+	}
+	return resp, err
+}
+
+func (s *CouponService) validateCoupon(ctx context.Context, req models.ValidateCouponRequest) (resp models.ValidateCouponResponse, err error) {
+	clientTime := req.Timestamp
+	var skewed bool
+	req.Timestamp, skewed = s.requestTime(req.Timestamp)
+
 	tx, err := s.Repo.DBHelper.PostgresClient.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
 	if err != nil {
 		return resp, errors.New("failed to start transaction")
@@ -105,104 +466,320 @@ func (s *CouponService) ValidateCoupon(ctx context.Context, req models.ValidateC
 			panic(p)
 		} else if err != nil {
 			tx.Rollback()
+			err = serializationError(err)
 		}
 	}()
 
-	coupon, err := s.fetchCouponFromDB(ctx, tx, req.CouponCode)
-	if err != nil {
-		return resp, err
+	if req.IdempotencyKey != "" {
+		var stored models.ValidateCouponResponse
+		found, err := s.storedResponse(ctx, tx, req.IdempotencyKey, idempotencyValidate, req.UserID, req.CouponCode, &stored)
+		if err != nil {
+			return resp, err
+		}
+		if found {
+			return stored, tx.Commit()
+		}
 	}
 
-	if req.Timestamp.After(coupon.ExpiryDate) {
-		return resp, errors.New("coupon expired")
+	coupon, discount, err := s.evaluateCoupon(ctx, tx, req, true)
+	if err != nil {
+		return resp, err
 	}
-
-	if req.Timestamp.Before(coupon.ValidTimeWindow.Start) || req.Timestamp.After(coupon.ValidTimeWindow.End) {
-		return resp, errors.New("coupon not valid at this time")
+	if err := s.checkOrderStack(ctx, tx, req, coupon, discount); err != nil {
+		return resp, err
 	}
 
-	usageCount, err := s.Repo.GetUserUsageCount(ctx, tx, req.UserID, req.CouponCode)
+	usageID, err := s.Repo.RecordUsage(ctx, tx, req.UserID, coupon.CouponCode, req.OrderID, discount.ledger(), req.Timestamp)
 	if err != nil {
 		return resp, err
 	}
-	if usageCount >= coupon.MaxUsagePerUser {
-		return resp, errors.New("usage limit reached")
+	if skewed {
+		if err := s.Repo.FlagClockSkew(ctx, tx, usageID, clientTime); err != nil {
+			return resp, err
+		}
 	}
 
-	applicable := false
-	for _, item := range req.CartItems {
-		if contains(coupon.ApplicableMedicineIDs, item.ID) || contains(coupon.ApplicableCategories, item.Category) {
-			applicable = true
-			break
+	resp = models.ValidateCouponResponse{
+		IsValid:   true,
+		Currency:  currencyOf(req.Currency),
+		Discount:  discount.Amounts,
+		LineItems: discount.LineItems,
+		FreeUnits: discount.FreeUnits,
+		Tier:      discount.Tier,
+		ClockSkew: skewed,
+		Message:   "coupon applied successfully",
+		UsageID:   usageID,
+	}
+
+	if req.IdempotencyKey != "" {
+		err = s.Repo.SaveIdempotentResponse(ctx, tx, req.IdempotencyKey, idempotencyValidate, req.UserID, coupon.CouponCode, resp)
+		if err == repository.ErrDuplicateKey {
+			return models.ValidateCouponResponse{}, ErrIdempotencyInFlight
+		}
+		if err != nil {
+			return models.ValidateCouponResponse{}, err
 		}
 	}
-	if !applicable {
-		return resp, errors.New("coupon not applicable to cart items")
+
+	if err := tx.Commit(); err != nil {
+		return models.ValidateCouponResponse{}, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	if req.OrderTotal < coupon.MinOrderValue {
-		return resp, errors.New("order total does not meet minimum requirement")
+	// Invalidate coupon cache as the usage may impact validity
+	s.RedisHelper.Delete(ctx, "valid_coupons")
+
+	return resp, nil
+}
+
+// Operations an idempotency key can be stored for. A key belongs to the first
+// operation it was used with.
+const (
+	idempotencyValidate = "validate"
+	idempotencyReserve  = "reserve"
+)
+
+// lostIdempotencyRace reports whether err may come from losing a race with
+// another request that used the same idempotency key, in which case that
+// request's response is worth looking for.
+func lostIdempotencyRace(err error) bool {
+	return errors.Is(err, ErrIdempotencyInFlight) || errors.Is(err, ErrConcurrentUpdate)
+}
+
+// replayCommitted looks for the response stored for key by a request that
+// has since committed, reading outside the transaction that lost the race.
+// Once the first request succeeds, retries get its response rather than a
+// conflict.
+func (s *CouponService) replayCommitted(ctx context.Context, key, operation, userID, couponCode string, resp any) (bool, error) {
+	tx, err := s.Repo.DBHelper.PostgresClient.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	// Nothing is written, so the transaction is always rolled back.
+	defer tx.Rollback()
 
-	discount := calculateDiscount(coupon, req.OrderTotal)
+	return s.storedResponse(ctx, tx, key, operation, userID, couponCode, resp)
+}
 
-	err = s.Repo.RecordUsage(ctx, tx, req.UserID, coupon.CouponCode, req.Timestamp)
+// storedResponse loads the response stored for key into resp and reports
+// whether there was one. A key stored for another operation, user or coupon
+// is ErrIdempotencyKeyReused.
+func (s *CouponService) storedResponse(ctx context.Context, tx *sql.Tx, key, operation, userID, couponCode string, resp any) (bool, error) {
+	storedOperation, storedUser, storedCode, err := s.Repo.GetIdempotentResponse(ctx, tx, key, operation, resp)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
 	if err != nil {
-		return resp, err
+		return false, err
 	}
+	if storedOperation != operation || storedUser != userID || storedCode != couponCode {
+		return false, ErrIdempotencyKeyReused
+	}
+	return true, nil
+}
 
-	if err := tx.Commit(); err != nil {
-		return resp, errors.New("failed to commit transaction")
+// QuoteCoupon runs the same checks as ValidateCoupon and returns the discount
+// the coupon would grant, without recording a usage.
+func (s *CouponService) QuoteCoupon(ctx context.Context, req models.ValidateCouponRequest) (resp models.ValidateCouponResponse, err error) {
+	var skewed bool
+	req.Timestamp, skewed = s.requestTime(req.Timestamp)
+
+	tx, err := s.Repo.DBHelper.PostgresClient.BeginTx(ctx, nil)
+	if err != nil {
+		return resp, errors.New("failed to start transaction")
 	}
+	// Nothing is written, so the transaction is always rolled back.
+	defer tx.Rollback()
 
-	// Invalidate coupon cache as the usage may impact validity
-	s.RedisHelper.Delete(ctx, "valid_coupons")
+	coupon, discount, err := s.evaluateCoupon(ctx, tx, req, false)
+	if err != nil {
+		return resp, err
+	}
+	if err := s.checkOrderStack(ctx, tx, req, coupon, discount); err != nil {
+		return resp, err
+	}
 
 	resp = models.ValidateCouponResponse{
-		IsValid:  true,
-		Discount: discount,
-		Message:  "coupon applied successfully",
+		IsValid:   true,
+		Currency:  currencyOf(req.Currency),
+		Discount:  discount.Amounts,
+		LineItems: discount.LineItems,
+		FreeUnits: discount.FreeUnits,
+		Tier:      discount.Tier,
+		ClockSkew: skewed,
+		Message:   "coupon can be applied",
 	}
 	return resp, nil
 }
 
+// evaluateCoupon loads the requested coupon, checks that req is allowed to
+// use it and returns the discount it grants. Callers that go on to record a
+// usage pass lock so that the coupon row is held for the rest of tx; quotes,
+// which write nothing, read it without a lock.
+func (s *CouponService) evaluateCoupon(ctx context.Context, tx *sql.Tx, req models.ValidateCouponRequest, lock bool) (models.Coupon, discountResult, error) {
+	var coupon models.Coupon
+	var err error
+	if lock {
+		coupon, err = s.fetchCouponFromDB(ctx, tx, req.CouponCode)
+	} else {
+		coupon, err = s.findCoupon(ctx, req.CouponCode)
+	}
+	if err != nil {
+		return coupon, discountResult{}, err
+	}
+
+	if !isRedeemable(coupon.Status) {
+		return coupon, discountResult{}, ErrCouponInactive
+	}
+
+	// From here on every amount is in the order's currency.
+	coupon, rate, err := s.couponIn(ctx, coupon, currencyOf(req.Currency))
+	if err != nil {
+		return coupon, discountResult{}, err
+	}
+
+	var usage couponUsage
+	if usage.userUses, err = s.Repo.GetUserUsageCount(ctx, tx, req.UserID, req.CouponCode, s.Clock.Now()); err != nil {
+		return coupon, discountResult{}, err
+	}
+	// When the coupon row is locked above, these totals cannot move until
+	// the transaction ends.
+	totalCount, given, err := s.Repo.GetCouponUsageTotals(ctx, tx, req.CouponCode, s.Clock.Now())
+	if err != nil {
+		return coupon, discountResult{}, err
+	}
+	usage.totalUses, usage.totalGiven = totalCount, convertMoney(given, rate)
+	if coupon.SegmentRules != nil {
+		profile, err := s.Profiles.GetUserProfile(ctx, req.UserID)
+		if err != nil {
+			return coupon, discountResult{}, err
+		}
+		usage.profile = &profile
+	}
+
+	if err := checkCoupon(coupon, req, usage); err != nil {
+		return coupon, discountResult{}, err
+	}
+
+	discount := calculateDiscount(coupon, req.CartItems, req.OrderTotal, req.DeliveryFee)
+	capToBudget(coupon, discount, usage.totalGiven)
+	discount.rate = rate
+
+	return coupon, discount, nil
+}
+
 func (s *CouponService) fetchCouponFromDB(ctx context.Context, tx *sql.Tx, couponCode string) (models.Coupon, error) {
 	coupon, err := s.Repo.GetCouponByCode(ctx, tx, couponCode)
+	if err == sql.ErrNoRows {
+		return models.Coupon{}, ErrCouponNotFound
+	}
 	if err != nil {
-		return models.Coupon{}, errors.New("coupon not found")
+		return models.Coupon{}, err
 	}
 	return coupon, nil
 }
 
+// findCoupon loads a coupon without locking it, for callers that write nothing.
+func (s *CouponService) findCoupon(ctx context.Context, couponCode string) (models.Coupon, error) {
+	coupon, err := s.Repo.FindCouponByCode(ctx, couponCode)
+	if err == sql.ErrNoRows {
+		return models.Coupon{}, ErrCouponNotFound
+	}
+	if err != nil {
+		return models.Coupon{}, err
+	}
+	return coupon, nil
+}
+
+// applicableCoupon checks one live coupon the way evaluateCoupon would,
+// using usage counts read up front rather than under a lock. It restates c in
+// currency as a side effect. profile is fetched on first need and shared
+// across calls.
+func (s *CouponService) applicableCoupon(ctx context.Context, c *models.Coupon, req models.ApplicableCouponsRequest, currency string, userUses map[string]int, profile **models.UserProfile) error {
+	if !isRedeemable(c.Status) {
+		return ErrCouponInactive
+	}
+	converted, _, err := s.couponIn(ctx, *c, currency)
+	if err != nil {
+		return err
+	}
+	*c = converted
+
+	usage := couponUsage{userUses: userUses[c.CouponCode]}
+	if stats := c.Redemptions; stats != nil {
+		usage.totalUses = stats.TotalRedemptions
+		usage.totalGiven = stats.TotalDiscountGiven
+	}
+	if req.UserID != "" && c.SegmentRules != nil {
+		if *profile == nil {
+			p, err := s.Profiles.GetUserProfile(ctx, req.UserID)
+			if err != nil {
+				return err
+			}
+			*profile = &p
+		}
+		usage.profile = *profile
+	}
+	return checkCoupon(*c, req.ForCoupon(c.CouponCode), usage)
+}
+
 // Helpers
-func contains(slice []string, target string) bool {
-	for _, item := range slice {
-		if item == target {
+func summarize(c models.Coupon) models.CouponSummary {
+	return models.CouponSummary{
+		CouponCode:         c.CouponCode,
+		DiscountType:       c.DiscountType,
+		DiscountValue:      c.DiscountValue,
+		DiscountTarget:     c.DiscountTarget,
+		ExpiryDate:         c.ExpiryDate,
+		TermsAndConditions: c.TermsAndConditions,
+	}
+}
+
+func notApplicable(c models.Coupon, reason models.IneligibleReason, err error) models.IneligibleCoupon {
+	return models.IneligibleCoupon{CouponSummary: summarize(c), Reason: reason, Message: err.Error()}
+}
+
+// withheld reports whether a coupon left out for reason is kept off the
+// ineligible list. The caller could never be offered it, so naming it would
+// only give away a code meant for someone else.
+func withheld(reason models.IneligibleReason) bool {
+	return reason == models.IneligibleSegment || reason == models.IneligibleAlreadyRedeemed
+}
+
+func canTransition(from, to models.CouponStatus) bool {
+	for _, next := range allowedTransitions[from] {
+		if next == to {
 			return true
 		}
 	}
 	return false
 }
 
-func calculateDiscount(coupon models.Coupon, orderTotal float64) map[string]float64 {
-	discount := make(map[string]float64)
+// isRedeemable reports whether a coupon in this state may be applied to an
+// order. Scheduled coupons still have to pass the time window check.
+func isRedeemable(status models.CouponStatus) bool {
+	return status == models.CouponStatusActive || status == models.CouponStatusScheduled
+}
 
-	switch coupon.DiscountType {
-	case models.DiscountTypeFlat:
-		discount[string(coupon.DiscountTarget)] = min(coupon.DiscountValue, coupon.MaxDiscountAmount)
-	case models.DiscountTypePercentage:
-		calculated := (orderTotal * coupon.DiscountValue) / 100
-		discount[string(coupon.DiscountTarget)] = min(calculated, coupon.MaxDiscountAmount)
-	}
-	return discount
+func encodeCursor(code string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(code))
 }
 
-func min(a, b float64) float64 {
-	if b <= 0 {
-		return a
+func decodeCursor(cursor string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+	code, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", ErrInvalidCursor
 	}
-	if a < b {
-		return a
+	return string(code), nil
+}
+
+func contains(slice []string, target string) bool {
+	for _, item := range slice {
+		if item == target {
+			return true
+		}
 	}
-	return b
+	return false
 }
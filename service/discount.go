@@ -0,0 +1,361 @@
+package service
+
+import (
+	"maps"
+	"math/big"
+	"math/bits"
+	"slices"
+	"sort"
+
+	"github.com/Puneet-Vishnoi/Coupon-System/models"
+)
+
+// discountResult is what a coupon is worth against a particular cart.
+type discountResult struct {
+	Amounts   map[string]models.Money // keyed by discount target, as returned to clients
+	LineItems []models.LineItemDiscount
+	FreeUnits []models.FreeUnit
+	Tier      *models.DiscountTier // nil when the base discount applied
+
+	// rate converts the coupon's own currency into the order's. Set by
+	// evaluateCoupon.
+	rate *big.Rat
+}
+
+func (d discountResult) total() models.Money {
+	var total models.Money
+	for _, amount := range d.Amounts {
+		total += amount
+	}
+	return total
+}
+
+// ledger is the total in the coupon's own currency, which usages and budgets
+// are recorded in.
+func (d discountResult) ledger() models.Money {
+	return convertMoney(d.total(), new(big.Rat).Inv(d.rate))
+}
+
+// clone copies d so that capping the copy leaves d untouched.
+func (d discountResult) clone() discountResult {
+	c := d
+	c.Amounts = maps.Clone(d.Amounts)
+	c.LineItems = slices.Clone(d.LineItems)
+	return c
+}
+
+// capTo scales the discount down, line items included, so that it does not
+// exceed limit.
+func (d discountResult) capTo(limit models.Money) {
+	total := d.total()
+	if total <= limit || total == 0 {
+		return
+	}
+	for k, amount := range d.Amounts {
+		d.Amounts[k] = models.Money(mulDiv(int64(amount), int64(limit), int64(total)))
+	}
+	weights := make([]int64, len(d.LineItems))
+	for i, line := range d.LineItems {
+		weights[i] = int64(line.Discount)
+	}
+	spread(d.LineItems, d.total(), weights)
+}
+
+// capToBudget holds discount to what is left of the coupon's total discount
+// budget once given has been granted, so the last redemption gets the rest of
+// the budget rather than overshooting it. given is in the order currency.
+func capToBudget(coupon models.Coupon, discount discountResult, given models.Money) {
+	if coupon.MaxTotalDiscountBudget > 0 {
+		discount.capTo(coupon.MaxTotalDiscountBudget - given)
+	}
+}
+
+// isTargeted reports whether the coupon only applies to part of the cart.
+func isTargeted(coupon models.Coupon) bool {
+	return isWhitelisted(coupon) || len(coupon.ExcludedMedicineIDs) > 0 || len(coupon.ExcludedCategories) > 0
+}
+
+func isWhitelisted(coupon models.Coupon) bool {
+	return len(coupon.ApplicableMedicineIDs) > 0 || len(coupon.ApplicableCategories) > 0
+}
+
+// isItemEligible reports whether the coupon may discount item. Exclusions
+// always win; past them, coupons that are not restricted to medicines or
+// categories apply to every item.
+func isItemEligible(coupon models.Coupon, item models.CartItem) bool {
+	if contains(coupon.ExcludedMedicineIDs, item.ID) || contains(coupon.ExcludedCategories, item.Category) {
+		return false
+	}
+	if !isWhitelisted(coupon) {
+		return true
+	}
+	return contains(coupon.ApplicableMedicineIDs, item.ID) || contains(coupon.ApplicableCategories, item.Category)
+}
+
+// eligibleUnits counts the units in items that the coupon may discount.
+func eligibleUnits(coupon models.Coupon, items []models.CartItem) int {
+	var units int
+	for _, item := range items {
+		if isItemEligible(coupon, item) {
+			units += item.Units()
+		}
+	}
+	return units
+}
+
+// deliveryApplies reports whether a delivery coupon can discount this
+// delivery. Order coupons are never restricted by delivery.
+func deliveryApplies(coupon models.Coupon, deliveryFee models.Money, deliveryType string) bool {
+	if coupon.DiscountTarget != models.DiscountTargetDelivery {
+		return true
+	}
+	if deliveryFee <= 0 {
+		return false
+	}
+	return len(coupon.ApplicableDeliveryTypes) == 0 || contains(coupon.ApplicableDeliveryTypes, deliveryType)
+}
+
+// requiredUnits is the smallest number of eligible units a cart needs before
+// the coupon can apply.
+func requiredUnits(coupon models.Coupon) int {
+	required := coupon.MinEligibleUnits
+	if coupon.DiscountType == models.DiscountTypeBuyXGetY && coupon.BuyXGetY != nil {
+		required = max(required, coupon.BuyXGetY.BuyQuantity+coupon.BuyXGetY.GetQuantity)
+	}
+	return required
+}
+
+// calculateDiscount works out what coupon takes off the cart. Order-level
+// coupons are applied to the eligible items only and the result is split
+// across those items in proportion to their price. Delivery coupons are
+// applied to the delivery fee and never exceed it.
+func calculateDiscount(coupon models.Coupon, items []models.CartItem, orderTotal, deliveryFee models.Money) discountResult {
+	if coupon.DiscountType == models.DiscountTypeBuyXGetY {
+		return calculateBuyXGetY(coupon, items, orderTotal)
+	}
+
+	best := calculateBaseDiscount(coupon, items, orderTotal, deliveryFee)
+	for i, tier := range coupon.Tiers {
+		if orderTotal < tier.Threshold {
+			break
+		}
+		tiered := coupon
+		tiered.DiscountType, tiered.DiscountValue = tier.DiscountType, tier.DiscountValue
+		if result := calculateBaseDiscount(tiered, items, orderTotal, deliveryFee); result.total() > best.total() {
+			best = result
+			best.Tier = &coupon.Tiers[i]
+		}
+	}
+	return best
+}
+
+// nextTier returns the lowest tier the order total has not reached yet.
+func nextTier(coupon models.Coupon, orderTotal models.Money) *models.NextTier {
+	for _, tier := range coupon.Tiers {
+		if orderTotal < tier.Threshold {
+			return &models.NextTier{DiscountTier: tier, AmountNeeded: tier.Threshold - orderTotal}
+		}
+	}
+	return nil
+}
+
+// calculateBaseDiscount applies the coupon's DiscountType and DiscountValue,
+// ignoring any tiers.
+func calculateBaseDiscount(coupon models.Coupon, items []models.CartItem, orderTotal, deliveryFee models.Money) discountResult {
+	result := discountResult{Amounts: make(map[string]models.Money)}
+
+	base := orderTotal
+	switch coupon.DiscountTarget {
+	case models.DiscountTargetDelivery:
+		base = deliveryFee
+	case models.DiscountTargetOrder:
+		var eligibleTotal models.Money
+		for _, item := range items {
+			if isItemEligible(coupon, item) {
+				eligibleTotal += item.LineTotal()
+				result.LineItems = append(result.LineItems, models.LineItemDiscount{
+					MedicineID:     item.ID,
+					Category:       item.Category,
+					Quantity:       item.Units(),
+					EligibleAmount: item.LineTotal(),
+				})
+			}
+		}
+		// Never discount more than the order is worth, even if the cart
+		// lines add up to more than the stated total.
+		if isTargeted(coupon) && eligibleTotal < orderTotal {
+			base = eligibleTotal
+		}
+	}
+
+	var amount models.Money
+	switch coupon.DiscountType {
+	case models.DiscountTypeFlat:
+		amount = coupon.DiscountValue
+	case models.DiscountTypePercentage:
+		amount = roundAmount(coupon, int64(base)*int64(coupon.DiscountValue), percentScale)
+	case models.DiscountTypeFreeDelivery:
+		amount = base
+	}
+	if amount > base {
+		amount = base
+	}
+	amount = min(amount, coupon.MaxDiscountAmount)
+
+	result.Amounts[string(coupon.DiscountTarget)] = amount
+	allocate(result.LineItems, amount)
+	return result
+}
+
+// calculateBuyXGetY lines up every eligible unit from most to least
+// expensive and walks them in groups of BuyQuantity+GetQuantity. The last
+// GetQuantity units of each complete group, the cheapest ones, are discounted.
+func calculateBuyXGetY(coupon models.Coupon, items []models.CartItem, orderTotal models.Money) discountResult {
+	result := discountResult{Amounts: make(map[string]models.Money)}
+	cfg := coupon.BuyXGetY
+	if cfg == nil || cfg.BuyQuantity <= 0 || cfg.GetQuantity <= 0 {
+		result.Amounts[string(coupon.DiscountTarget)] = 0
+		return result
+	}
+
+	type unit struct {
+		line  int
+		price models.Money
+	}
+	var units []unit
+	for _, item := range items {
+		if !isItemEligible(coupon, item) {
+			continue
+		}
+		line := len(result.LineItems)
+		result.LineItems = append(result.LineItems, models.LineItemDiscount{
+			MedicineID:     item.ID,
+			Category:       item.Category,
+			Quantity:       item.Units(),
+			EligibleAmount: item.LineTotal(),
+		})
+		for i := 0; i < item.Units(); i++ {
+			units = append(units, unit{line: line, price: item.Price})
+		}
+	}
+	sort.SliceStable(units, func(i, j int) bool { return units[i].price > units[j].price })
+
+	// Work in price times percent so the total is rounded once, not per unit.
+	weights := make([]int64, len(result.LineItems))
+	freeCount := make([]int, len(result.LineItems))
+	var raw int64
+	group := cfg.BuyQuantity + cfg.GetQuantity
+	for start := 0; start+group <= len(units); start += group {
+		for _, u := range units[start+cfg.BuyQuantity : start+group] {
+			off := int64(u.price) * int64(coupon.DiscountValue)
+			weights[u.line] += off
+			freeCount[u.line]++
+			raw += off
+		}
+	}
+
+	for i, line := range result.LineItems {
+		if freeCount[i] > 0 {
+			result.FreeUnits = append(result.FreeUnits, models.FreeUnit{
+				MedicineID: line.MedicineID,
+				Quantity:   freeCount[i],
+				UnitPrice:  line.EligibleAmount / models.Money(line.Quantity),
+			})
+		}
+	}
+
+	amount := roundAmount(coupon, raw, percentScale)
+	if amount > orderTotal {
+		amount = orderTotal
+	}
+	amount = min(amount, coupon.MaxDiscountAmount)
+	result.Amounts[string(coupon.DiscountTarget)] = amount
+	spread(result.LineItems, amount, weights)
+	return result
+}
+
+// percentScale turns price times a percentage held as Money (15.00% is 1500)
+// back into minor units.
+const percentScale = 100 * 100
+
+// roundAmount divides num by den and rounds the result to the coupon's
+// rounding unit using its rounding mode.
+func roundAmount(coupon models.Coupon, num, den int64) models.Money {
+	unit := int64(coupon.RoundingUnit)
+	if unit <= 0 {
+		unit = 1
+	}
+	den *= unit
+
+	q, r := num/den, num%den
+	switch coupon.RoundingMode {
+	case models.RoundingModeFloor:
+	case models.RoundingModeCeil:
+		if r > 0 {
+			q++
+		}
+	default: // half_up
+		if 2*r >= den {
+			q++
+		}
+	}
+	return models.Money(q * unit)
+}
+
+// allocate splits amount across lines in proportion to their eligible amount.
+func allocate(lines []models.LineItemDiscount, amount models.Money) {
+	weights := make([]int64, len(lines))
+	for i, line := range lines {
+		weights[i] = int64(line.EligibleAmount)
+	}
+	spread(lines, amount, weights)
+}
+
+// spread sets each line's discount to its weighted share of amount. Shares
+// are rounded down to the paisa and the last weighted line absorbs the
+// remainder, so they always add up to amount exactly.
+func spread(lines []models.LineItemDiscount, amount models.Money, weights []int64) {
+	var totalWeight int64
+	last := -1
+	for i, w := range weights {
+		if w > 0 {
+			totalWeight += w
+			last = i
+		}
+	}
+	if totalWeight == 0 {
+		return
+	}
+
+	remaining := amount
+	for i := range lines {
+		switch {
+		case i == last:
+			lines[i].Discount = remaining
+		case i > last:
+			lines[i].Discount = 0
+		default:
+			lines[i].Discount = models.Money(mulDiv(int64(amount), weights[i], totalWeight))
+			remaining -= lines[i].Discount
+		}
+	}
+}
+
+// mulDiv returns a*b/c rounded down without overflowing on the product.
+// All arguments must be non-negative and c positive.
+func mulDiv(a, b, c int64) int64 {
+	hi, lo := bits.Mul64(uint64(a), uint64(b))
+	q, _ := bits.Div64(hi, lo, uint64(c))
+	return int64(q)
+}
+
+// min returns the smaller of a and b, treating a non-positive b as "no cap".
+func min(a, b models.Money) models.Money {
+	if b <= 0 {
+		return a
+	}
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/Puneet-Vishnoi/Coupon-System/models"
+)
+
+// couponUsage is how much of a coupon has been spent when a request is
+// checked against it. Amounts are in the order currency.
+type couponUsage struct {
+	userUses   int // live uses held by the requesting user
+	totalUses  int // live uses across all users
+	totalGiven models.Money
+
+	// profile is the requesting user's profile, or nil to skip segment
+	// rules when the user is unknown.
+	profile *models.UserProfile
+}
+
+// checkCoupon applies every redemption rule to coupon, whose amounts must
+// already be in the order currency. The redeem path and the applicable list
+// both use it, so the list only offers coupons that would redeem. The checks
+// run in a fixed order; the minimum order value comes last so that a coupon
+// failing on it is one that more spend alone would unlock.
+func checkCoupon(coupon models.Coupon, req models.ValidateCouponRequest, usage couponUsage) error {
+	if req.Timestamp.After(coupon.ExpiryDate) {
+		return ErrCouponExpired
+	}
+	if req.Timestamp.Before(coupon.ValidTimeWindow.Start) || req.Timestamp.After(coupon.ValidTimeWindow.End) {
+		return ErrOutsideTimeWindow
+	}
+	scheduled, err := inSchedule(coupon.Schedule, req.Timestamp)
+	if err != nil {
+		return err
+	}
+	if !scheduled {
+		return ErrOutsideSchedule
+	}
+	if usage.profile != nil && !inSegment(coupon.SegmentRules, *usage.profile, req.Timestamp) {
+		return ErrSegmentNotEligible
+	}
+
+	if coupon.MaxUsagePerUser > 0 && usage.userUses >= coupon.MaxUsagePerUser {
+		return ErrUsageLimitReached
+	}
+	// A single-use code is spent once anyone has redeemed or reserved it.
+	if coupon.UsageType == models.UsageTypeSingleUse && usage.totalUses > 0 {
+		return ErrCouponAlreadyRedeemed
+	}
+	if coupon.MaxTotalRedemptions > 0 && usage.totalUses >= coupon.MaxTotalRedemptions {
+		return ErrRedemptionCapReached
+	}
+	if coupon.MaxTotalDiscountBudget > 0 && usage.totalGiven >= coupon.MaxTotalDiscountBudget {
+		return ErrBudgetExhausted
+	}
+
+	if !deliveryApplies(coupon, req.DeliveryFee, req.DeliveryType) {
+		return ErrDeliveryNotApplicable
+	}
+	units := eligibleUnits(coupon, req.CartItems)
+	if units == 0 {
+		return ErrNoEligibleItems
+	}
+	if units < requiredUnits(coupon) {
+		return ErrNotEnoughUnits
+	}
+	if req.OrderTotal < coupon.MinOrderValue {
+		return ErrBelowMinOrder
+	}
+	return nil
+}
+
+// ineligibleReasons maps the errors checkCoupon and couponIn return onto the
+// reason codes clients match on.
+var ineligibleReasons = []struct {
+	err    error
+	reason models.IneligibleReason
+}{
+	{ErrCouponInactive, models.IneligibleInactive},
+	{ErrCurrencyMismatch, models.IneligibleCurrencyMismatch},
+	{ErrExchangeRateUnavailable, models.IneligibleRateUnavailable},
+	{ErrCouponExpired, models.IneligibleExpired},
+	{ErrOutsideTimeWindow, models.IneligibleOutsideTimeWindow},
+	{ErrOutsideSchedule, models.IneligibleOutsideSchedule},
+	{ErrSegmentNotEligible, models.IneligibleSegment},
+	{ErrUsageLimitReached, models.IneligibleUsageLimitReached},
+	{ErrCouponAlreadyRedeemed, models.IneligibleAlreadyRedeemed},
+	{ErrRedemptionCapReached, models.IneligibleRedemptionCapReached},
+	{ErrBudgetExhausted, models.IneligibleBudgetExhausted},
+	{ErrDeliveryNotApplicable, models.IneligibleDeliveryNotApplicable},
+	{ErrNoEligibleItems, models.IneligibleNoEligibleItems},
+	{ErrNotEnoughUnits, models.IneligibleNotEnoughUnits},
+	{ErrBelowMinOrder, models.IneligibleBelowMinOrder},
+}
+
+// ineligibleReason returns the reason code for err, or false if err is not a
+// rule failure.
+func ineligibleReason(err error) (models.IneligibleReason, bool) {
+	for _, r := range ineligibleReasons {
+		if errors.Is(err, r.err) {
+			return r.reason, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,39 @@
+package service
+
+import "github.com/Puneet-Vishnoi/Coupon-System/repository"
+
+// ErrorKind says what sort of failure a domain error is. Handlers turn it
+// into an HTTP status.
+type ErrorKind int
+
+const (
+	KindInvalid  ErrorKind = iota + 1 // the request or coupon definition is malformed
+	KindNotFound                      // the coupon, reservation or usage does not exist
+	KindConflict                      // clashes with the current state of the resource
+	KindRejected                      // well formed, but the coupon rules refuse it
+)
+
+// Error is a domain error with a stable code that clients can match on
+// instead of the message. Sentinels are compared with errors.Is and may be
+// wrapped with fmt.Errorf to add detail.
+type Error struct {
+	Code    string
+	Kind    ErrorKind
+	Message string
+}
+
+func (e *Error) Error() string { return e.Message }
+
+func newError(kind ErrorKind, code, message string) *Error {
+	return &Error{Code: code, Kind: kind, Message: message}
+}
+
+// serializationError turns Postgres aborting a serializable transaction into
+// ErrConcurrentUpdate, so that the client is told to retry rather than given
+// an internal error. Other errors are returned unchanged.
+func serializationError(err error) error {
+	if repository.IsSerializationFailure(err) {
+		return ErrConcurrentUpdate
+	}
+	return err
+}
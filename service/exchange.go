@@ -0,0 +1,146 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/Puneet-Vishnoi/Coupon-System/models"
+)
+
+var (
+	ErrCurrencyMismatch        = newError(KindRejected, "CURRENCY_MISMATCH", "coupon currency does not match the order currency")
+	ErrExchangeRateUnavailable = newError(KindRejected, "EXCHANGE_RATE_UNAVAILABLE", "no exchange rate for currency pair")
+)
+
+// ExchangeRateProvider converts amounts for coupons that are allowed to apply
+// to orders in another currency.
+type ExchangeRateProvider interface {
+	// Rate returns how much one unit of from is worth in to.
+	Rate(ctx context.Context, from, to string) (*big.Rat, error)
+}
+
+// StaticRateProvider serves fixed rates held in memory, each quoted against a
+// single base currency.
+type StaticRateProvider struct {
+	base  string
+	rates map[string]*big.Rat // value of one unit of the currency in base
+}
+
+// NewStaticRateProvider builds a provider from rates quoted against base,
+// e.g. base INR with {"USD": "83.10"}.
+func NewStaticRateProvider(base string, rates map[string]string) (*StaticRateProvider, error) {
+	p := &StaticRateProvider{base: base, rates: map[string]*big.Rat{base: big.NewRat(1, 1)}}
+	for currency, rate := range rates {
+		r, ok := new(big.Rat).SetString(rate)
+		if !ok || r.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid exchange rate %q for %s", rate, currency)
+		}
+		p.rates[strings.ToUpper(currency)] = r
+	}
+	return p, nil
+}
+
+// ParseExchangeRates reads rates written as "USD=83.10,EUR=90.25", each the
+// value of one unit in base, into a StaticRateProvider.
+func ParseExchangeRates(base, spec string) (*StaticRateProvider, error) {
+	rates := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		currency, rate, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid exchange rate entry %q", pair)
+		}
+		rates[strings.TrimSpace(currency)] = strings.TrimSpace(rate)
+	}
+	return NewStaticRateProvider(base, rates)
+}
+
+func (p *StaticRateProvider) Rate(ctx context.Context, from, to string) (*big.Rat, error) {
+	fromRate, ok := p.rates[from]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s to %s", ErrExchangeRateUnavailable, from, to)
+	}
+	toRate, ok := p.rates[to]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s to %s", ErrExchangeRateUnavailable, from, to)
+	}
+	return new(big.Rat).Quo(fromRate, toRate), nil
+}
+
+// currencyOf fills in the default currency for coupons and requests that
+// predate multi-currency support.
+func currencyOf(code string) string {
+	if code == "" {
+		return models.DefaultCurrency
+	}
+	return code
+}
+
+// convertMoney multiplies m by rate, rounding half up to the minor unit.
+func convertMoney(m models.Money, rate *big.Rat) models.Money {
+	v := new(big.Rat).Mul(new(big.Rat).SetInt64(int64(m)), rate)
+	q, r := new(big.Int).QuoRem(v.Num(), v.Denom(), new(big.Int))
+	if r.Abs(r).Lsh(r, 1).Cmp(v.Denom()) >= 0 {
+		if v.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return models.Money(q.Int64())
+}
+
+// couponIn returns coupon with every amount restated in currency, along with
+// the rate used. Percentages are left alone. Coupons that do not allow cross
+// currency use fail with ErrCurrencyMismatch.
+func (s *CouponService) couponIn(ctx context.Context, coupon models.Coupon, currency string) (models.Coupon, *big.Rat, error) {
+	from := currencyOf(coupon.Currency)
+	if from == currency {
+		return coupon, big.NewRat(1, 1), nil
+	}
+	if !coupon.AllowCrossCurrency {
+		return coupon, nil, ErrCurrencyMismatch
+	}
+	if s.Rates == nil {
+		return coupon, nil, fmt.Errorf("%w: %s to %s", ErrExchangeRateUnavailable, from, currency)
+	}
+	rate, err := s.Rates.Rate(ctx, from, currency)
+	if err != nil {
+		return coupon, nil, err
+	}
+
+	converted := coupon
+	converted.Currency = currency
+	if coupon.DiscountType == models.DiscountTypeFlat {
+		converted.DiscountValue = convertMoney(coupon.DiscountValue, rate)
+	}
+	converted.MinOrderValue = convertMoney(coupon.MinOrderValue, rate)
+	converted.MaxDiscountAmount = convertMoney(coupon.MaxDiscountAmount, rate)
+	converted.MaxTotalDiscountBudget = convertMoney(coupon.MaxTotalDiscountBudget, rate)
+	if coupon.RoundingUnit > 0 {
+		converted.RoundingUnit = max(convertMoney(coupon.RoundingUnit, rate), 1)
+	}
+	if stats := coupon.Redemptions; stats != nil {
+		convertedStats := *stats
+		convertedStats.TotalDiscountGiven = convertMoney(stats.TotalDiscountGiven, rate)
+		if stats.RemainingDiscountBudget != nil {
+			remaining := convertMoney(*stats.RemainingDiscountBudget, rate)
+			convertedStats.RemainingDiscountBudget = &remaining
+		}
+		converted.Redemptions = &convertedStats
+	}
+	converted.Tiers = make([]models.DiscountTier, len(coupon.Tiers))
+	for i, tier := range coupon.Tiers {
+		converted.Tiers[i] = tier
+		converted.Tiers[i].Threshold = convertMoney(tier.Threshold, rate)
+		if tier.DiscountType == models.DiscountTypeFlat {
+			converted.Tiers[i].DiscountValue = convertMoney(tier.DiscountValue, rate)
+		}
+	}
+	return converted, rate, nil
+}
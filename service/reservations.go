@@ -0,0 +1,214 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Puneet-Vishnoi/Coupon-System/models"
+	"github.com/Puneet-Vishnoi/Coupon-System/repository"
+)
+
+const defaultReservationTTL = 15 * time.Minute
+
+var (
+	ErrReservationNotFound = newError(KindNotFound, "RESERVATION_NOT_FOUND", "reservation not found")
+	ErrReservationExpired  = newError(KindConflict, "RESERVATION_EXPIRED", "reservation expired")
+	ErrReservationState    = newError(KindConflict, "RESERVATION_NOT_PENDING", "reservation is no longer pending")
+	ErrReservationOrder    = newError(KindConflict, "RESERVATION_ORDER_MISMATCH", "reservation is held for a different order")
+)
+
+// ReserveCoupon runs the redeem checks and holds one use of the coupon for the
+// user. The hold counts toward MaxUsagePerUser until it is confirmed, released
+// or expires. A repeated idempotency key returns the first reservation instead
+// of holding another use.
+func (s *CouponService) ReserveCoupon(ctx context.Context, req models.ReserveCouponRequest) (models.ReserveCouponResponse, error) {
+	resp, err := s.reserveCoupon(ctx, req)
+	if req.IdempotencyKey != "" && lostIdempotencyRace(err) {
+		var stored models.ReserveCouponResponse
+		found, replayErr := s.replayCommitted(ctx, req.IdempotencyKey, idempotencyReserve, req.UserID, req.CouponCode, &stored)
+		if found {
+			return stored, nil
+		}
+		if errors.Is(replayErr, ErrIdempotencyKeyReused) {
+			return resp, replayErr
+		}
+	}
+	return resp, err
+}
+
+func (s *CouponService) reserveCoupon(ctx context.Context, req models.ReserveCouponRequest) (resp models.ReserveCouponResponse, err error) {
+	clientTime := req.Timestamp
+	var skewed bool
+	req.Timestamp, skewed = s.requestTime(req.Timestamp)
+
+	tx, err := s.Repo.DBHelper.PostgresClient.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return resp, errors.New("failed to start transaction")
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+			err = serializationError(err)
+		}
+	}()
+
+	if req.IdempotencyKey != "" {
+		var stored models.ReserveCouponResponse
+		found, err := s.storedResponse(ctx, tx, req.IdempotencyKey, idempotencyReserve, req.UserID, req.CouponCode, &stored)
+		if err != nil {
+			return resp, err
+		}
+		if found {
+			return stored, tx.Commit()
+		}
+	}
+
+	coupon, discount, err := s.evaluateCoupon(ctx, tx, req.ValidateCouponRequest, true)
+	if err != nil {
+		return resp, err
+	}
+	if err := s.checkOrderStack(ctx, tx, req.ValidateCouponRequest, coupon, discount); err != nil {
+		return resp, err
+	}
+
+	ttl := defaultReservationTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	expiresAt := s.Clock.Now().Add(ttl)
+
+	id, err := s.Repo.ReserveUsage(ctx, tx, req.UserID, coupon.CouponCode, req.OrderID, discount.ledger(), req.Timestamp, expiresAt)
+	if err != nil {
+		return resp, err
+	}
+	if skewed {
+		if err := s.Repo.FlagClockSkew(ctx, tx, id, clientTime); err != nil {
+			return resp, err
+		}
+	}
+
+	resp = models.ReserveCouponResponse{
+		ReservationID: id,
+		IsValid:       true,
+		Currency:      currencyOf(req.Currency),
+		Discount:      discount.Amounts,
+		LineItems:     discount.LineItems,
+		FreeUnits:     discount.FreeUnits,
+		Tier:          discount.Tier,
+		ExpiresAt:     expiresAt,
+		ClockSkew:     skewed,
+		Message:       "coupon reserved",
+	}
+
+	if req.IdempotencyKey != "" {
+		err = s.Repo.SaveIdempotentResponse(ctx, tx, req.IdempotencyKey, idempotencyReserve, req.UserID, coupon.CouponCode, resp)
+		if err == repository.ErrDuplicateKey {
+			return models.ReserveCouponResponse{}, ErrIdempotencyInFlight
+		}
+		if err != nil {
+			return models.ReserveCouponResponse{}, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.ReserveCouponResponse{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	s.RedisHelper.Delete(ctx, "valid_coupons")
+	return resp, nil
+}
+
+// ConfirmReservation turns a pending reservation into a redemption for
+// orderID. Confirming the same reservation again with the same order is a no-op.
+func (s *CouponService) ConfirmReservation(ctx context.Context, id int64, orderID string) (models.CouponUsage, error) {
+	return s.settleReservation(ctx, id, models.UsageStatusConfirmed, orderID)
+}
+
+// ReleaseReservation gives a pending reservation back to the user.
+func (s *CouponService) ReleaseReservation(ctx context.Context, id int64) (models.CouponUsage, error) {
+	return s.settleReservation(ctx, id, models.UsageStatusReleased, "")
+}
+
+func (s *CouponService) settleReservation(ctx context.Context, id int64, to models.UsageStatus, orderID string) (usage models.CouponUsage, err error) {
+	tx, err := s.Repo.DBHelper.PostgresClient.BeginTx(ctx, nil)
+	if err != nil {
+		return usage, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	usage, err = s.Repo.GetUsage(ctx, tx, id)
+	if err == sql.ErrNoRows {
+		return usage, ErrReservationNotFound
+	}
+	if err != nil {
+		return usage, err
+	}
+
+	// Retried calls that already reached the target state succeed quietly.
+	if usage.Status == to && (orderID == "" || usage.OrderID == orderID) {
+		return usage, tx.Commit()
+	}
+	if usage.Status != models.UsageStatusReserved {
+		return usage, fmt.Errorf("%w: reservation is %s", ErrReservationState, usage.Status)
+	}
+	// A reservation made for an order can only be confirmed for that order.
+	if orderID != "" && usage.OrderID != "" && usage.OrderID != orderID {
+		return usage, fmt.Errorf("%w: %s", ErrReservationOrder, usage.OrderID)
+	}
+	if to == models.UsageStatusConfirmed && usage.ReservedUntil != nil && !usage.ReservedUntil.After(s.Clock.Now()) {
+		return usage, ErrReservationExpired
+	}
+
+	if err := s.Repo.SetUsageStatus(ctx, tx, id, to, orderID); err != nil {
+		return usage, err
+	}
+	usage.Status = to
+	if orderID != "" {
+		usage.OrderID = orderID
+	}
+
+	if err := tx.Commit(); err != nil {
+		return usage, err
+	}
+	return usage, nil
+}
+
+// StartReservationSweeper expires stale reservations every interval until ctx
+// is cancelled. Expiry is also enforced at read time, so the sweeper only keeps
+// the usage table tidy.
+func (s *CouponService) StartReservationSweeper(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				n, err := s.Repo.ExpireReservations(ctx, s.Clock.Now())
+				if err != nil {
+					log.Printf("reservation sweeper: %v", err)
+					continue
+				}
+				if n > 0 {
+					log.Printf("reservation sweeper: expired %d reservations", n)
+				}
+			}
+		}
+	}()
+}
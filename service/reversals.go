@@ -0,0 +1,88 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/Puneet-Vishnoi/Coupon-System/models"
+)
+
+var (
+	ErrUsageNotFound      = newError(KindNotFound, "USAGE_NOT_FOUND", "usage not found")
+	ErrUsageNotReversible = newError(KindConflict, "USAGE_NOT_REVERSIBLE", "usage cannot be reversed")
+)
+
+// ReverseUsage undoes confirmed redemptions, either a single usage or every
+// usage recorded against an order. Rows are kept and marked reversed so the
+// user gets the use back while the history stays intact.
+func (s *CouponService) ReverseUsage(ctx context.Context, req models.ReverseUsageRequest) (resp models.ReverseUsageResponse, err error) {
+	tx, err := s.Repo.DBHelper.PostgresClient.BeginTx(ctx, nil)
+	if err != nil {
+		return resp, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var usages []models.CouponUsage
+	if req.UsageID != 0 {
+		usage, err := s.Repo.GetUsage(ctx, tx, req.UsageID)
+		if err == sql.ErrNoRows {
+			return resp, ErrUsageNotFound
+		}
+		if err != nil {
+			return resp, err
+		}
+		if req.OrderID != "" && usage.OrderID != req.OrderID {
+			return resp, ErrUsageNotFound
+		}
+		usages = append(usages, usage)
+	} else {
+		usages, err = s.Repo.GetUsagesByOrder(ctx, tx, req.OrderID)
+		if err != nil {
+			return resp, err
+		}
+		if len(usages) == 0 {
+			return resp, ErrUsageNotFound
+		}
+	}
+
+	resp.Reversed = []models.CouponUsage{}
+	for _, usage := range usages {
+		switch usage.Status {
+		case models.UsageStatusReversed:
+			// Already undone by an earlier call.
+			resp.Reversed = append(resp.Reversed, usage)
+			continue
+		case models.UsageStatusConfirmed:
+		default:
+			if req.UsageID != 0 {
+				return resp, fmt.Errorf("%w: usage is %s", ErrUsageNotReversible, usage.Status)
+			}
+			// Holds on an order that never completed have nothing to undo.
+			continue
+		}
+
+		if err := s.Repo.SetUsageStatus(ctx, tx, usage.ID, models.UsageStatusReversed, ""); err != nil {
+			return resp, err
+		}
+		if err := s.Repo.RecordReversal(ctx, tx, usage.ID, usage.OrderID, req.Reason); err != nil {
+			return resp, err
+		}
+		usage.Status = models.UsageStatusReversed
+		resp.Reversed = append(resp.Reversed, usage)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return resp, err
+	}
+
+	s.RedisHelper.Delete(ctx, "valid_coupons")
+	return resp, nil
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/Puneet-Vishnoi/Coupon-System/models"
+)
+
+// ErrInvalidCoupon wraps every reason a coupon definition is rejected on
+// create or update.
+var ErrInvalidCoupon = newError(KindInvalid, "INVALID_COUPON", "invalid coupon")
+
+// maxPercent is 100% written as Money, which holds percentages to two places.
+const maxPercent models.Money = 100_00
+
+// validateCouponRules checks the business rules that span several fields and
+// so cannot be expressed as validator tags. It may normalise c in place.
+func validateCouponRules(c *models.Coupon) error {
+	switch c.UsageType {
+	case models.UsageTypeSingleUse:
+		// A single-use code is redeemed once in total, so no user can
+		// ever get more than one use out of it.
+		if c.MaxUsagePerUser > 1 {
+			return fmt.Errorf("%w: single_use coupons cannot allow %d uses per user", ErrInvalidCoupon, c.MaxUsagePerUser)
+		}
+		if c.MaxTotalRedemptions > 1 {
+			return fmt.Errorf("%w: single_use coupons cannot allow %d redemptions in total", ErrInvalidCoupon, c.MaxTotalRedemptions)
+		}
+		c.MaxUsagePerUser = 1
+	case models.UsageTypeMultiUse:
+		// MaxUsagePerUser of 0 leaves a shared code uncapped per user.
+	default:
+		return fmt.Errorf("%w: unknown usage_type %q", ErrInvalidCoupon, c.UsageType)
+	}
+
+	if c.DiscountType != models.DiscountTypeFreeDelivery && c.DiscountValue <= 0 {
+		return fmt.Errorf("%w: discount_value must be greater than 0", ErrInvalidCoupon)
+	}
+
+	switch c.DiscountType {
+	case models.DiscountTypeFlat:
+	case models.DiscountTypePercentage:
+		if c.DiscountValue > maxPercent {
+			return fmt.Errorf("%w: percentage discount cannot exceed 100", ErrInvalidCoupon)
+		}
+	case models.DiscountTypeBuyXGetY:
+		if c.BuyXGetY == nil || c.BuyXGetY.BuyQuantity <= 0 || c.BuyXGetY.GetQuantity <= 0 {
+			return fmt.Errorf("%w: buy_x_get_y coupons need buy_quantity and get_quantity", ErrInvalidCoupon)
+		}
+		if c.DiscountValue > maxPercent {
+			return fmt.Errorf("%w: buy_x_get_y discount cannot exceed 100 percent", ErrInvalidCoupon)
+		}
+		if c.DiscountTarget != models.DiscountTargetOrder {
+			return fmt.Errorf("%w: buy_x_get_y coupons discount items, not %s", ErrInvalidCoupon, c.DiscountTarget)
+		}
+	case models.DiscountTypeFreeDelivery:
+		if c.DiscountTarget != models.DiscountTargetDelivery {
+			return fmt.Errorf("%w: free_delivery coupons must target delivery", ErrInvalidCoupon)
+		}
+		c.DiscountValue = 0
+	default:
+		return fmt.Errorf("%w: unknown discount_type %q", ErrInvalidCoupon, c.DiscountType)
+	}
+	if c.DiscountType != models.DiscountTypeBuyXGetY {
+		c.BuyXGetY = nil
+	}
+
+	if len(c.Tiers) > 0 && c.DiscountType == models.DiscountTypeBuyXGetY {
+		return fmt.Errorf("%w: buy_x_get_y coupons cannot have tiers", ErrInvalidCoupon)
+	}
+	threshold := c.MinOrderValue
+	for _, tier := range c.Tiers {
+		if tier.Threshold <= threshold {
+			return fmt.Errorf("%w: tier thresholds must rise above min_order_value", ErrInvalidCoupon)
+		}
+		if tier.DiscountType == models.DiscountTypePercentage && tier.DiscountValue > maxPercent {
+			return fmt.Errorf("%w: percentage discount cannot exceed 100", ErrInvalidCoupon)
+		}
+		threshold = tier.Threshold
+	}
+
+	if err := validateSchedule(c.Schedule); err != nil {
+		return err
+	}
+
+	if c.Currency == "" {
+		c.Currency = models.DefaultCurrency
+	}
+	if c.RoundingMode == "" {
+		c.RoundingMode = models.RoundingModeHalfUp
+	}
+	if c.RoundingUnit == 0 {
+		c.RoundingUnit = 1
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // schedules name IANA zones, which slim images do not ship
+
+	"github.com/Puneet-Vishnoi/Coupon-System/models"
+)
+
+var ErrOutsideSchedule = newError(KindRejected, "OUTSIDE_SCHEDULE", "coupon is not available at this time")
+
+const (
+	clockLayout = "15:04"
+	dateLayout  = "2006-01-02"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// inSchedule reports whether t falls inside the recurring schedule. A nil
+// schedule places no restriction. Days, hour windows and blackout dates are
+// all judged on the wall clock of the schedule's timezone. The part of a
+// window that runs past midnight belongs to the day the window opened.
+func inSchedule(schedule *models.RecurringSchedule, t time.Time) (bool, error) {
+	if schedule == nil {
+		return true, nil
+	}
+	loc, err := time.LoadLocation(schedule.Timezone)
+	if err != nil {
+		return false, fmt.Errorf("invalid schedule timezone %q: %w", schedule.Timezone, err)
+	}
+	local := t.In(loc)
+
+	if len(schedule.HourWindows) == 0 {
+		return onScheduledDay(schedule, local), nil
+	}
+	minute := local.Hour()*60 + local.Minute()
+	for _, w := range schedule.HourWindows {
+		start, end, err := w.Minutes()
+		if err != nil {
+			return false, err
+		}
+		// A window that ends at or before its start runs past midnight.
+		if start < end && minute >= start && minute < end && onScheduledDay(schedule, local) {
+			return true, nil
+		}
+		if start >= end && minute >= start && onScheduledDay(schedule, local) {
+			return true, nil
+		}
+		if start >= end && minute < end && onScheduledDay(schedule, local.AddDate(0, 0, -1)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// onScheduledDay reports whether the calendar day of local is one the
+// schedule runs on: listed in DaysOfWeek, if any are, and not blacked out.
+func onScheduledDay(schedule *models.RecurringSchedule, local time.Time) bool {
+	if contains(schedule.BlackoutDates, local.Format(dateLayout)) {
+		return false
+	}
+	if len(schedule.DaysOfWeek) == 0 {
+		return true
+	}
+	for _, day := range schedule.DaysOfWeek {
+		if weekdays[strings.ToLower(day)] == local.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSchedule checks the parts of a schedule that validator tags cannot.
+func validateSchedule(schedule *models.RecurringSchedule) error {
+	if schedule == nil {
+		return nil
+	}
+	if _, err := time.LoadLocation(schedule.Timezone); err != nil {
+		return fmt.Errorf("%w: unknown timezone %q", ErrInvalidCoupon, schedule.Timezone)
+	}
+	for _, day := range schedule.DaysOfWeek {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("%w: unknown day of week %q", ErrInvalidCoupon, day)
+		}
+	}
+	for _, w := range schedule.HourWindows {
+		if _, _, err := w.Minutes(); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidCoupon, err)
+		}
+	}
+	for _, date := range schedule.BlackoutDates {
+		if _, err := time.Parse(dateLayout, date); err != nil {
+			return fmt.Errorf("%w: blackout date %q is not YYYY-MM-DD", ErrInvalidCoupon, date)
+		}
+	}
+	return nil
+}
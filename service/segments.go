@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Puneet-Vishnoi/Coupon-System/models"
+)
+
+var ErrSegmentNotEligible = newError(KindRejected, "SEGMENT_NOT_ELIGIBLE", "user is not eligible for this coupon")
+
+// UserProfileProvider resolves the customer facts that segment rules need.
+// Unknown users must come back as an empty profile, not an error.
+type UserProfileProvider interface {
+	GetUserProfile(ctx context.Context, userID string) (models.UserProfile, error)
+}
+
+// InMemoryUserProfiles is a UserProfileProvider backed by a map, for tests
+// and local development.
+type InMemoryUserProfiles struct {
+	mu       sync.RWMutex
+	profiles map[string]models.UserProfile
+}
+
+func NewInMemoryUserProfiles(profiles ...models.UserProfile) *InMemoryUserProfiles {
+	p := &InMemoryUserProfiles{profiles: make(map[string]models.UserProfile)}
+	for _, profile := range profiles {
+		p.profiles[profile.UserID] = profile
+	}
+	return p
+}
+
+func (p *InMemoryUserProfiles) GetUserProfile(ctx context.Context, userID string) (models.UserProfile, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if profile, ok := p.profiles[userID]; ok {
+		return profile, nil
+	}
+	return models.UserProfile{UserID: userID}, nil
+}
+
+// Set adds or replaces a profile.
+func (p *InMemoryUserProfiles) Set(profile models.UserProfile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.profiles[profile.UserID] = profile
+}
+
+// inSegment reports whether profile satisfies every rule set on the coupon.
+// A nil rule set lets everyone in.
+func inSegment(rules *models.SegmentRules, profile models.UserProfile, now time.Time) bool {
+	if rules == nil {
+		return true
+	}
+	if rules.FirstOrderOnly && profile.OrderCount > 0 {
+		return false
+	}
+	if rules.MaxPriorOrders != nil && profile.OrderCount > *rules.MaxPriorOrders {
+		return false
+	}
+	if rules.MinDaysSinceLastOrder > 0 {
+		// Someone who has never ordered has not lapsed.
+		if profile.LastOrderAt == nil {
+			return false
+		}
+		lapsedAt := profile.LastOrderAt.AddDate(0, 0, rules.MinDaysSinceLastOrder)
+		if now.Before(lapsedAt) {
+			return false
+		}
+	}
+	for _, segment := range rules.RequiredSegments {
+		if !contains(profile.Segments, segment) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,396 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/Puneet-Vishnoi/Coupon-System/models"
+	"github.com/Puneet-Vishnoi/Coupon-System/repository"
+)
+
+var (
+	ErrCouponNotStackable    = newError(KindRejected, "COUPON_NOT_STACKABLE", "coupon cannot be combined with other coupons")
+	ErrStackingGroupConflict = newError(KindRejected, "STACKING_GROUP_CONFLICT", "a coupon from the same stacking group is already applied")
+	ErrCombinedCapReached    = newError(KindRejected, "COMBINED_CAP_REACHED", "combined discount limit for the order has been reached")
+)
+
+// stackEntry is one requested code while a stack is being worked out. err
+// holds the reason the coupon was rejected, if it was.
+type stackEntry struct {
+	code     string
+	coupon   models.Coupon
+	discount discountResult
+	err      error
+}
+
+// QuoteStack works out which of the requested coupons combine and what they
+// are worth together, without recording any usage.
+func (s *CouponService) QuoteStack(ctx context.Context, req models.StackCouponsRequest) (resp models.StackCouponsResponse, err error) {
+	var skewed bool
+	req.Timestamp, skewed = s.requestTime(req.Timestamp)
+
+	tx, err := s.Repo.DBHelper.PostgresClient.BeginTx(ctx, nil)
+	if err != nil {
+		return resp, errors.New("failed to start transaction")
+	}
+	// Nothing is written, so the transaction is always rolled back.
+	defer tx.Rollback()
+
+	entries, err := s.evaluateStack(ctx, tx, req, false)
+	if err != nil {
+		return resp, err
+	}
+
+	resp = stackResponse(entries, currencyOf(req.Currency), nil)
+	resp.ClockSkew = skewed
+	if resp.IsValid {
+		resp.Message = "coupons can be applied"
+	}
+	return resp, nil
+}
+
+// RedeemStack applies the coupons that combine and records a usage for each
+// of them. Rejected coupons are reported but not used up. A repeated
+// idempotency key returns the first response instead of redeeming again.
+func (s *CouponService) RedeemStack(ctx context.Context, req models.StackCouponsRequest) (models.StackCouponsResponse, error) {
+	resp, err := s.redeemStack(ctx, req)
+	if req.IdempotencyKey != "" && lostIdempotencyRace(err) {
+		stored, found, replayErr := s.replayCommittedStack(ctx, req)
+		if found {
+			return stored, nil
+		}
+		if errors.Is(replayErr, ErrIdempotencyKeyReused) {
+			return resp, replayErr
+		}
+	}
+	return resp, err
+}
+
+func (s *CouponService) redeemStack(ctx context.Context, req models.StackCouponsRequest) (resp models.StackCouponsResponse, err error) {
+	clientTime := req.Timestamp
+	var skewed bool
+	req.Timestamp, skewed = s.requestTime(req.Timestamp)
+
+	tx, err := s.Repo.DBHelper.PostgresClient.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return resp, errors.New("failed to start transaction")
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		} else if err != nil {
+			tx.Rollback()
+			err = serializationError(err)
+		}
+	}()
+
+	if req.IdempotencyKey != "" {
+		stored, found, err := s.storedStackResponse(ctx, tx, req)
+		if err != nil {
+			return resp, err
+		}
+		if found {
+			return stored, tx.Commit()
+		}
+	}
+
+	entries, err := s.evaluateStack(ctx, tx, req, true)
+	if err != nil {
+		return resp, err
+	}
+
+	usageIDs := make(map[string]int64)
+	for _, e := range entries {
+		if e.err != nil {
+			continue
+		}
+		usageID, err := s.Repo.RecordUsage(ctx, tx, req.UserID, e.code, req.OrderID, e.discount.ledger(), req.Timestamp)
+		if err != nil {
+			return resp, err
+		}
+		if skewed {
+			if err := s.Repo.FlagClockSkew(ctx, tx, usageID, clientTime); err != nil {
+				return resp, err
+			}
+		}
+		usageIDs[e.code] = usageID
+	}
+
+	resp = stackResponse(entries, currencyOf(req.Currency), usageIDs)
+	resp.ClockSkew = skewed
+	if resp.IsValid {
+		resp.Message = "coupons applied successfully"
+	}
+
+	if req.IdempotencyKey != "" {
+		err = s.Repo.SaveStackIdempotentResponse(ctx, tx, req.IdempotencyKey, req.UserID, req.CouponCodes, resp)
+		if err == repository.ErrDuplicateKey {
+			return models.StackCouponsResponse{}, ErrIdempotencyInFlight
+		}
+		if err != nil {
+			return models.StackCouponsResponse{}, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.StackCouponsResponse{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if len(usageIDs) > 0 {
+		s.RedisHelper.Delete(ctx, "valid_coupons")
+	}
+	return resp, nil
+}
+
+// replayCommittedStack is replayCommitted for stacked redemptions.
+func (s *CouponService) replayCommittedStack(ctx context.Context, req models.StackCouponsRequest) (models.StackCouponsResponse, bool, error) {
+	tx, err := s.Repo.DBHelper.PostgresClient.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return models.StackCouponsResponse{}, false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	// Nothing is written, so the transaction is always rolled back.
+	defer tx.Rollback()
+
+	return s.storedStackResponse(ctx, tx, req)
+}
+
+// storedStackResponse loads the response stored for req's idempotency key
+// and reports whether there was one. A key stored for another user or set of
+// codes is ErrIdempotencyKeyReused.
+func (s *CouponService) storedStackResponse(ctx context.Context, tx *sql.Tx, req models.StackCouponsRequest) (models.StackCouponsResponse, bool, error) {
+	userID, couponCodes, stored, err := s.Repo.GetStackIdempotentResponse(ctx, tx, req.IdempotencyKey)
+	if err == sql.ErrNoRows {
+		return stored, false, nil
+	}
+	if err != nil {
+		return stored, false, err
+	}
+	if userID != req.UserID || !slices.Equal(couponCodes, req.CouponCodes) {
+		return models.StackCouponsResponse{}, false, ErrIdempotencyKeyReused
+	}
+	return stored, true, nil
+}
+
+// evaluateStack checks every requested coupon on its own, then combines them
+// in precedence order. Each coupon is priced against the full cart; the caps
+// stop the total from running past what the order is worth. Entries come back
+// in the order the codes were requested, duplicates removed. lock is passed on
+// to evaluateCoupon.
+func (s *CouponService) evaluateStack(ctx context.Context, tx *sql.Tx, req models.StackCouponsRequest, lock bool) ([]stackEntry, error) {
+	var entries []stackEntry
+	seen := make(map[string]bool)
+	for _, code := range req.CouponCodes {
+		if !seen[code] {
+			seen[code] = true
+			entries = append(entries, stackEntry{code: code})
+		}
+	}
+
+	// Visit coupons in code order so that two redemptions locking the same
+	// coupons cannot deadlock.
+	byCode := make([]*stackEntry, len(entries))
+	for i := range entries {
+		byCode[i] = &entries[i]
+	}
+	sort.Slice(byCode, func(i, j int) bool { return byCode[i].code < byCode[j].code })
+	for _, e := range byCode {
+		e.coupon, e.discount, e.err = s.evaluateCoupon(ctx, tx, req.ForCoupon(e.code), lock)
+		// Only rule failures reject a single coupon; anything else, such as
+		// a lost database connection, fails the whole stack.
+		var domainErr *Error
+		if e.err != nil && !errors.As(e.err, &domainErr) {
+			return nil, e.err
+		}
+	}
+
+	prior, err := s.orderEntries(ctx, tx, req.OrderID, currencyOf(req.Currency))
+	if err != nil {
+		return nil, err
+	}
+
+	byPrecedence := make([]*stackEntry, len(entries))
+	for i := range entries {
+		byPrecedence[i] = &entries[i]
+	}
+	sort.SliceStable(byPrecedence, func(i, j int) bool {
+		return byPrecedence[i].coupon.Precedence < byPrecedence[j].coupon.Precedence
+	})
+	s.combineStack(prior, byPrecedence, req.OrderTotal, req.DeliveryFee)
+	return entries, nil
+}
+
+// checkOrderStack holds a single-code redemption to the stacking rules and
+// the combined cap against the coupons already applied to the same order, so
+// that redeeming codes one at a time cannot get round them. discount is capped
+// in place. A request without an order ID, or for an order with no coupons
+// yet, is not checked.
+func (s *CouponService) checkOrderStack(ctx context.Context, tx *sql.Tx, req models.ValidateCouponRequest, coupon models.Coupon, discount discountResult) error {
+	prior, err := s.orderEntries(ctx, tx, req.OrderID, currencyOf(req.Currency))
+	if err != nil || len(prior) == 0 {
+		return err
+	}
+	entry := stackEntry{code: coupon.CouponCode, coupon: coupon, discount: discount}
+	s.combineStack(prior, []*stackEntry{&entry}, req.OrderTotal, req.DeliveryFee)
+	return entry.err
+}
+
+// orderEntries returns the coupons already redeemed or held against orderID
+// as applied stack entries, with their discounts in currency. Orders are only
+// known by ID, so an empty orderID has none.
+func (s *CouponService) orderEntries(ctx context.Context, tx *sql.Tx, orderID, currency string) ([]*stackEntry, error) {
+	if orderID == "" {
+		return nil, nil
+	}
+	discounts, err := s.Repo.GetOrderDiscounts(ctx, tx, orderID, s.Clock.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, len(discounts))
+	for code := range discounts {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	entries := make([]*stackEntry, 0, len(codes))
+	for _, code := range codes {
+		coupon, err := s.findCoupon(ctx, code)
+		if err != nil {
+			return nil, err
+		}
+		coupon, rate, err := s.couponIn(ctx, coupon, currency)
+		if err != nil {
+			return nil, err
+		}
+		// Only the total is stored, so it is put against the coupon's target.
+		entries = append(entries, &stackEntry{
+			code:   code,
+			coupon: coupon,
+			discount: discountResult{
+				Amounts: map[string]models.Money{string(coupon.DiscountTarget): convertMoney(discounts[code], rate)},
+				rate:    rate,
+			},
+		})
+	}
+	return entries, nil
+}
+
+// combineStack walks entries, which must be in precedence order, and keeps
+// those that the stacking rules and the combined cap allow. The others are
+// given the reason they were rejected. Discounts of kept entries are capped
+// in place. prior holds coupons already applied to the order; they count
+// against the caps and the stacking rules but are not changed.
+func (s *CouponService) combineStack(prior, entries []*stackEntry, orderTotal, deliveryFee models.Money) {
+	left := orderTotal + deliveryFee
+	if s.MaxCombinedDiscountPercent > 0 {
+		if limit := models.Money(mulDiv(int64(orderTotal), int64(s.MaxCombinedDiscountPercent), percentScale)); limit < left {
+			left = limit
+		}
+	}
+	leftByTarget := map[string]models.Money{
+		string(models.DiscountTargetOrder):    orderTotal,
+		string(models.DiscountTargetDelivery): deliveryFee,
+	}
+
+	applied := slices.Clone(prior)
+	for _, p := range prior {
+		for target, amount := range p.discount.Amounts {
+			if _, ok := leftByTarget[target]; ok {
+				leftByTarget[target] -= amount
+			}
+		}
+		left -= p.discount.total()
+	}
+
+	for _, e := range entries {
+		if e.err != nil {
+			continue
+		}
+		if e.err = stackConflict(e.coupon, applied); e.err != nil {
+			continue
+		}
+
+		// No target can be discounted by more than it costs, however
+		// many coupons touch it.
+		limit := left
+		over := models.Money(0)
+		for target, amount := range e.discount.Amounts {
+			if room, ok := leftByTarget[target]; ok && amount > room {
+				over += amount - room
+			}
+		}
+		if fit := e.discount.total() - over; fit < limit {
+			limit = fit
+		}
+		if limit <= 0 {
+			e.err = ErrCombinedCapReached
+			continue
+		}
+		e.discount.capTo(limit)
+
+		for target, amount := range e.discount.Amounts {
+			if _, ok := leftByTarget[target]; ok {
+				leftByTarget[target] -= amount
+			}
+		}
+		left -= e.discount.total()
+		applied = append(applied, e)
+	}
+}
+
+// stackConflict reports why coupon cannot join the coupons already applied,
+// or nil if it can.
+func stackConflict(coupon models.Coupon, applied []*stackEntry) error {
+	for _, other := range applied {
+		switch {
+		case coupon.Exclusive:
+			return fmt.Errorf("%w: %s is exclusive", ErrCouponNotStackable, coupon.CouponCode)
+		case other.coupon.Exclusive:
+			return fmt.Errorf("%w: %s is exclusive", ErrCouponNotStackable, other.code)
+		case coupon.StackingGroup != "" && coupon.StackingGroup == other.coupon.StackingGroup:
+			return fmt.Errorf("%w: %s is in group %s", ErrStackingGroupConflict, other.code, coupon.StackingGroup)
+		}
+	}
+	return nil
+}
+
+// stackResponse sums the applied entries and explains the rejected ones.
+func stackResponse(entries []stackEntry, currency string, usageIDs map[string]int64) models.StackCouponsResponse {
+	resp := models.StackCouponsResponse{
+		Currency: currency,
+		Discount: make(map[string]models.Money),
+		Coupons:  make([]models.StackedCoupon, 0, len(entries)),
+		Message:  "no coupon could be applied",
+	}
+	for _, e := range entries {
+		if e.err != nil {
+			rejected := models.StackedCoupon{CouponCode: e.code, Reason: e.err.Error()}
+			var domainErr *Error
+			if errors.As(e.err, &domainErr) {
+				rejected.Code = domainErr.Code
+			}
+			resp.Coupons = append(resp.Coupons, rejected)
+			continue
+		}
+		resp.IsValid = true
+		for target, amount := range e.discount.Amounts {
+			resp.Discount[target] += amount
+		}
+		resp.TotalDiscount += e.discount.total()
+		resp.Coupons = append(resp.Coupons, models.StackedCoupon{
+			CouponCode: e.code,
+			Applied:    true,
+			Discount:   e.discount.Amounts,
+			LineItems:  e.discount.LineItems,
+			FreeUnits:  e.discount.FreeUnits,
+			Tier:       e.discount.Tier,
+			UsageID:    usageIDs[e.code],
+		})
+	}
+	return resp
+}
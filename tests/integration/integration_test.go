@@ -10,6 +10,7 @@ import (
 
 	"github.com/Puneet-Vishnoi/Coupon-System/models"
 	"github.com/Puneet-Vishnoi/Coupon-System/routes"
+	"github.com/Puneet-Vishnoi/Coupon-System/service"
 	"github.com/Puneet-Vishnoi/Coupon-System/tests/mockdb"
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/assert"
@@ -19,6 +20,7 @@ func TestCouponIntegration(t *testing.T) {
 	// Setup test dependencies
 	testDeps := mockdb.GetTestInstance()
 	defer testDeps.Cleanup()
+	testDeps.Service.Clock = service.FixedClock{Time: time.Date(2025, time.June, 1, 10, 30, 0, 0, time.UTC)}
 
 	// Start the test server
 	router := gin.Default()
@@ -33,14 +35,14 @@ func TestCouponIntegration(t *testing.T) {
 		UsageType:             "single_use",
 		ApplicableMedicineIDs: []string{"med001", "med002", "med003"},
 		ApplicableCategories:  []string{"pain_relief", "fever"},
-		MinOrderValue:         100.5,
+		MinOrderValue:         100_50,
 		ValidTimeWindow: models.TimeWindow{
 			Start: time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC),
 			End:   time.Date(2025, time.December, 31, 23, 59, 59, 0, time.UTC),
 		},
 		TermsAndConditions: "This coupon is valid for selected medicines only.",
 		DiscountType:       "percentage",
-		DiscountValue:      20,
+		DiscountValue:      20_00,
 		MaxUsagePerUser:    1,
 		DiscountTarget:     "total_order_value",
 	}
@@ -52,14 +54,33 @@ func TestCouponIntegration(t *testing.T) {
 	}
 	defer resp.Body.Close()
 
+	// 1.1 Read it back
+	resp, err = http.Get(server.URL + "/api/coupons/SAVE20")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to fetch coupon: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var fetched models.Coupon
+	if err := json.NewDecoder(resp.Body).Decode(&fetched); err != nil {
+		t.Fatalf("Failed to decode coupon: %v", err)
+	}
+	assert.Equal(t, fetched.CouponCode, "SAVE20")
+
+	resp, err = http.Get(server.URL + "/api/coupons/MISSING")
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 for unknown coupon: %v", err)
+	}
+	defer resp.Body.Close()
+
 	// 2. Check applicable
 	cartItems := []models.CartItem{
-		{ID: "med001", Category: "pain_relief", Price: 100.78},
-		{ID: "med004", Category: "fever", Price: 342.89},
+		{ID: "med001", Category: "pain_relief", Price: 100_78},
+		{ID: "med004", Category: "fever", Price: 342_89},
 	}
 	applicableReq := models.ApplicableCouponsRequest{
 		CartItems:  cartItems,
-		OrderTotal: 120.5,
+		OrderTotal: 120_50,
 		Timestamp:  time.Date(2025, time.June, 1, 10, 30, 0, 0, time.UTC),
 	}
 	applicableJSON, _ := json.Marshal(applicableReq)
@@ -74,7 +95,7 @@ func TestCouponIntegration(t *testing.T) {
 		UserID:     "Puneet001",
 		CouponCode: "SAVE20",
 		CartItems:  cartItems,
-		OrderTotal: 120.5,
+		OrderTotal: 120_50,
 		Timestamp:  time.Date(2025, time.June, 1, 10, 30, 0, 0, time.UTC),
 	}
 	validateJSON, _ := json.Marshal(validateReq)
@@ -90,5 +111,32 @@ func TestCouponIntegration(t *testing.T) {
 	}
 
 	assert.Equal(t, result.IsValid, true)
-	assert.Equal(t, result.Discount["total_order_value"], 24.1)
+	assert.Equal(t, result.Discount["total_order_value"], models.Money(24_10))
+
+	// 4. Rejections come back in the error envelope with a stable code
+	resp, err = http.Post(server.URL+"/api/coupons/validate", "application/json", bytes.NewBuffer(validateJSON))
+	if err != nil || resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected 422 for a spent coupon: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var rejection models.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rejection); err != nil {
+		t.Fatalf("Failed to decode error response: %v", err)
+	}
+	assert.Equal(t, rejection.Error.Code, "USAGE_LIMIT_REACHED")
+	assert.Equal(t, rejection.Error.Message, "usage limit reached")
+
+	resp, err = http.Post(server.URL+"/api/coupons/validate", "application/json", bytes.NewBufferString(`{"coupon_code": "SAVE20"}`))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an incomplete request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var invalid models.ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&invalid); err != nil {
+		t.Fatalf("Failed to decode error response: %v", err)
+	}
+	assert.Equal(t, invalid.Error.Code, "VALIDATION_FAILED")
+	assert.Equal(t, invalid.Error.Details["UserID"], "failed on tag 'required'")
 }
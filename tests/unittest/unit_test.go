@@ -2,12 +2,20 @@ package unittest
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/Puneet-Vishnoi/Coupon-System/models"
+	"github.com/Puneet-Vishnoi/Coupon-System/repository"
+	"github.com/Puneet-Vishnoi/Coupon-System/service"
 	"github.com/Puneet-Vishnoi/Coupon-System/tests/mockdb"
 	"github.com/go-playground/assert"
+	"github.com/lib/pq"
 )
 
 func setupTest(t *testing.T) *mockdb.TestDeps {
@@ -25,9 +33,9 @@ func TestValidateCoupon(t *testing.T) {
 	now := time.Date(2025, 5, 7, 12, 0, 0, 0, time.UTC)
 	baseCoupon := models.Coupon{
 		DiscountType:          "flat",
-		DiscountValue:         50,
+		DiscountValue:         50_00,
 		DiscountTarget:        "total_order_value",
-		MinOrderValue:         100,
+		MinOrderValue:         100_00,
 		MaxUsagePerUser:       1,
 		UsageType:             "single_use",
 		TermsAndConditions:    "Valid on medicine only",
@@ -54,7 +62,7 @@ func TestValidateCoupon(t *testing.T) {
 			},
 			request: models.ValidateCouponRequest{
 				UserID:     "user1",
-				OrderTotal: 200,
+				OrderTotal: 200_00,
 				Timestamp:  now,
 			},
 			wantErr: "coupon expired",
@@ -76,7 +84,7 @@ func TestValidateCoupon(t *testing.T) {
 			},
 			request: models.ValidateCouponRequest{
 				UserID:     "user2",
-				OrderTotal: 200,
+				OrderTotal: 200_00,
 				Timestamp:  now,
 			},
 			wantErr: "coupon not valid at this time",
@@ -86,7 +94,7 @@ func TestValidateCoupon(t *testing.T) {
 			setup: func(t *testing.T, test *mockdb.TestDeps) string {
 				c := baseCoupon
 				c.CouponCode = "MINFAIL"
-				c.MinOrderValue = 500
+				c.MinOrderValue = 500_00
 				c.ExpiryDate = now.Add(24 * time.Hour)
 				c.ValidTimeWindow = models.TimeWindow{
 					Start: now.Add(-24 * time.Hour),
@@ -99,7 +107,7 @@ func TestValidateCoupon(t *testing.T) {
 			},
 			request: models.ValidateCouponRequest{
 				UserID:     "user3",
-				OrderTotal: 100,
+				OrderTotal: 100_00,
 				CartItems:  []models.CartItem{{Category: "painkillers"}},
 				Timestamp:  now,
 			},
@@ -112,7 +120,7 @@ func TestValidateCoupon(t *testing.T) {
 			},
 			request: models.ValidateCouponRequest{
 				UserID:     "user4",
-				OrderTotal: 200,
+				OrderTotal: 200_00,
 				Timestamp:  now,
 			},
 			wantErr: "coupon not found",
@@ -134,7 +142,7 @@ func TestValidateCoupon(t *testing.T) {
 			},
 			request: models.ValidateCouponRequest{
 				UserID:     "user5",
-				OrderTotal: 200,
+				OrderTotal: 200_00,
 				Timestamp:  now,
 				CartItems:  []models.CartItem{{ID: "med001", Category: "painkillers"}},
 			},
@@ -145,6 +153,7 @@ func TestValidateCoupon(t *testing.T) {
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
 			test := setupTest(t)
+			test.Service.Clock = service.FixedClock{Time: now}
 			code := tc.setup(t, test)
 			tc.request.CouponCode = code
 			resp, err := test.Service.ValidateCoupon(context.Background(), tc.request)
@@ -167,10 +176,10 @@ func TestCreateCoupon(t *testing.T) {
 		ExpiryDate:            now.Add(48 * time.Hour),
 		UsageType:             "single_use",
 		ApplicableMedicineIDs: []string{"med101"},
-		MinOrderValue:         150,
+		MinOrderValue:         150_00,
 		ValidTimeWindow:       models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
 		DiscountType:          "flat",
-		DiscountValue:         30,
+		DiscountValue:         30_00,
 		MaxUsagePerUser:       1,
 		DiscountTarget:        "total_order_value",
 		TermsAndConditions:    "Valid only on med101",
@@ -180,9 +189,9 @@ func TestCreateCoupon(t *testing.T) {
 	invalid := &models.Coupon{
 		CouponCode:      "INVALID1",
 		DiscountType:    "flat",
-		DiscountValue:   -10,
+		DiscountValue:   -10_00,
 		DiscountTarget:  "total_order_value",
-		MinOrderValue:   100,
+		MinOrderValue:   100_00,
 		ExpiryDate:      now.Add(1 * time.Hour),
 		MaxUsagePerUser: 1,
 		UsageType:       "single_use",
@@ -199,11 +208,11 @@ func TestGetApplicableCoupons(t *testing.T) {
 		CouponCode:           "APPLICABLE1",
 		ExpiryDate:           now.Add(24 * time.Hour),
 		UsageType:            "multi_use",
-		MinOrderValue:        100,
+		MinOrderValue:        100_00,
 		ApplicableCategories: []string{"diabetes"},
 		ValidTimeWindow:      models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
 		DiscountType:         "flat",
-		DiscountValue:        20,
+		DiscountValue:        20_00,
 		DiscountTarget:       "total_order_value",
 		MaxUsagePerUser:      5,
 		TermsAndConditions:   "Applicable on diabetes category",
@@ -214,11 +223,11 @@ func TestGetApplicableCoupons(t *testing.T) {
 		CouponCode:           "NOTMATCHING",
 		ExpiryDate:           now.Add(24 * time.Hour),
 		UsageType:            "multi_use",
-		MinOrderValue:        100,
+		MinOrderValue:        100_00,
 		ApplicableCategories: []string{"painkillers"},
 		ValidTimeWindow:      models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
 		DiscountType:         "percentage",
-		DiscountValue:        10,
+		DiscountValue:        10_00,
 		DiscountTarget:       "total_order_value",
 		MaxUsagePerUser:      5,
 		TermsAndConditions:   "Applicable on painkillers",
@@ -226,13 +235,1563 @@ func TestGetApplicableCoupons(t *testing.T) {
 	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), coupon2))
 
 	req := models.ApplicableCouponsRequest{
-		OrderTotal: 150,
+		OrderTotal: 150_00,
 		Timestamp:  now,
-		CartItems:  []models.CartItem{{ID: "med301", Category: "diabetes", Price: 150}},
+		CartItems:  []models.CartItem{{ID: "med301", Category: "diabetes", Price: 150_00}},
 	}
 
-	coupons, err := test.Service.GetApplicableCoupons(context.Background(), req)
+	resp, err := test.Service.GetApplicableCoupons(context.Background(), req)
 	assert.Equal(t, nil, err)
-	assert.Equal(t, 1, len(coupons))
-	assert.Equal(t, "APPLICABLE1", coupons[0].CouponCode)
+	assert.Equal(t, 1, len(resp.Applicable))
+	assert.Equal(t, "APPLICABLE1", resp.Applicable[0].CouponCode)
+	assert.Equal(t, models.Money(20_00), resp.Applicable[0].TotalDiscount)
+	assert.Equal(t, 1, len(resp.Ineligible))
+	assert.Equal(t, "NOTMATCHING", resp.Ineligible[0].CouponCode)
+	assert.Equal(t, models.IneligibleNoEligibleItems, resp.Ineligible[0].Reason)
+}
+
+func TestListCoupons(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+
+	for _, code := range []string{"LIST1", "LIST2", "LIST3"} {
+		c := &models.Coupon{
+			CouponCode:           code,
+			ExpiryDate:           now.Add(24 * time.Hour),
+			UsageType:            "multi_use",
+			ApplicableCategories: []string{"vitamins"},
+			ValidTimeWindow:      models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
+			DiscountType:         "flat",
+			DiscountValue:        10_00,
+			DiscountTarget:       "total_order_value",
+			MaxUsagePerUser:      1,
+		}
+		assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+	}
+
+	page, err := test.Service.ListCoupons(context.Background(), models.ListCouponsRequest{Category: "vitamins", Limit: 2})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(page.Coupons))
+	assert.Equal(t, "LIST1", page.Coupons[0].CouponCode)
+	assert.NotEqual(t, "", page.NextCursor)
+
+	page, err = test.Service.ListCoupons(context.Background(), models.ListCouponsRequest{Category: "vitamins", Limit: 2, Cursor: page.NextCursor})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(page.Coupons))
+	assert.Equal(t, "LIST3", page.Coupons[0].CouponCode)
+	assert.Equal(t, "", page.NextCursor)
+
+	coupon, err := test.Service.GetCoupon(context.Background(), "LIST2")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "LIST2", coupon.CouponCode)
+
+	_, err = test.Service.GetCoupon(context.Background(), "MISSING")
+	assert.Equal(t, service.ErrCouponNotFound, err)
+}
+
+func TestUpdateCoupon(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+
+	c := &models.Coupon{
+		CouponCode:      "UPDATE1",
+		ExpiryDate:      now.Add(24 * time.Hour),
+		UsageType:       "multi_use",
+		ValidTimeWindow: models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
+		DiscountType:    "percentage",
+		DiscountValue:   10_00,
+		DiscountTarget:  "total_order_value",
+		MaxUsagePerUser: 1,
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+
+	first, err := test.Service.GetCoupon(context.Background(), "UPDATE1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, first.Version)
+
+	stale := first
+	first.MaxDiscountAmount = 100_00
+	assert.Equal(t, nil, test.Service.UpdateCoupon(context.Background(), &first))
+	assert.Equal(t, 2, first.Version)
+
+	stale.MaxDiscountAmount = 500_00
+	assert.Equal(t, service.ErrVersionConflict, test.Service.UpdateCoupon(context.Background(), &stale))
+
+	stored, err := test.Service.GetCoupon(context.Background(), "UPDATE1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, models.Money(100_00), stored.MaxDiscountAmount)
+
+	// A rule sent as null is removed; one left out of the patch is kept.
+	stored.Schedule = &models.RecurringSchedule{Timezone: "Asia/Kolkata", DaysOfWeek: []string{"mon"}}
+	stored.SegmentRules = &models.SegmentRules{}
+	var patch models.CouponPatch
+	assert.Equal(t, nil, json.Unmarshal([]byte(`{"schedule": null}`), &patch))
+	patch.ApplyTo(&stored)
+	assert.Equal(t, true, stored.Schedule == nil)
+	assert.Equal(t, true, stored.SegmentRules != nil)
+}
+
+func TestCouponLifecycle(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+
+	c := &models.Coupon{
+		CouponCode:           "LIFECYCLE1",
+		ExpiryDate:           now.Add(24 * time.Hour),
+		UsageType:            "multi_use",
+		ApplicableCategories: []string{"painkillers"},
+		ValidTimeWindow:      models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
+		DiscountType:         "flat",
+		DiscountValue:        20_00,
+		DiscountTarget:       "total_order_value",
+		MaxUsagePerUser:      5,
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+	assert.Equal(t, models.CouponStatusActive, c.Status)
+
+	req := models.ValidateCouponRequest{
+		UserID:     "lifecycle-user",
+		CouponCode: "LIFECYCLE1",
+		OrderTotal: 200_00,
+		Timestamp:  now,
+		CartItems:  []models.CartItem{{ID: "med001", Category: "painkillers", Price: 200_00}},
+	}
+
+	paused, err := test.Service.TransitionCoupon(context.Background(), "LIFECYCLE1", models.CouponStatusPaused)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, models.CouponStatusPaused, paused.Status)
+
+	_, err = test.Service.ValidateCoupon(context.Background(), req)
+	assert.Equal(t, service.ErrCouponInactive, err)
+
+	_, err = test.Service.TransitionCoupon(context.Background(), "LIFECYCLE1", models.CouponStatusActive)
+	assert.Equal(t, nil, err)
+
+	_, err = test.Service.ValidateCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+
+	_, err = test.Service.TransitionCoupon(context.Background(), "LIFECYCLE1", models.CouponStatusArchived)
+	assert.Equal(t, nil, err)
+
+	_, err = test.Service.TransitionCoupon(context.Background(), "LIFECYCLE1", models.CouponStatusActive)
+	assert.Equal(t, true, errors.Is(err, service.ErrInvalidTransition))
+
+	archived, err := test.Service.GetCoupon(context.Background(), "LIFECYCLE1")
+	assert.Equal(t, nil, err)
+	archived.MaxDiscountAmount = 50_00
+	assert.Equal(t, service.ErrCouponArchived, test.Service.UpdateCoupon(context.Background(), &archived))
+
+	// A new coupon cannot start out paused; that is a bad definition, not a
+	// clash with existing state.
+	fresh := *c
+	fresh.CouponCode = "LIFECYCLE2"
+	fresh.Status = models.CouponStatusPaused
+	assert.Equal(t, true, errors.Is(test.Service.CreateCoupon(context.Background(), &fresh), service.ErrInvalidCoupon))
+}
+
+func TestQuoteCouponDoesNotConsumeUsage(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+
+	c := &models.Coupon{
+		CouponCode:           "QUOTE1",
+		ExpiryDate:           now.Add(24 * time.Hour),
+		UsageType:            "single_use",
+		ApplicableCategories: []string{"painkillers"},
+		ValidTimeWindow:      models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
+		DiscountType:         "percentage",
+		DiscountValue:        10_00,
+		DiscountTarget:       "total_order_value",
+		MaxUsagePerUser:      1,
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+
+	req := models.ValidateCouponRequest{
+		UserID:     "quote-user",
+		CouponCode: "QUOTE1",
+		OrderTotal: 200_00,
+		Timestamp:  now,
+		CartItems:  []models.CartItem{{ID: "med001", Category: "painkillers", Price: 200_00}},
+	}
+
+	for i := 0; i < 2; i++ {
+		quote, err := test.Service.QuoteCoupon(context.Background(), req)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, models.Money(20_00), quote.Discount["total_order_value"])
+	}
+
+	// A quote does not wait on a redemption holding the coupon row.
+	lockTx, err := test.Service.Repo.DBHelper.PostgresClient.BeginTx(context.Background(), nil)
+	assert.Equal(t, nil, err)
+	_, err = test.Service.Repo.GetCouponByCode(context.Background(), lockTx, "QUOTE1")
+	assert.Equal(t, nil, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	_, err = test.Service.QuoteCoupon(ctx, req)
+	cancel()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, lockTx.Rollback())
+
+	_, err = test.Service.ValidateCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+
+	_, err = test.Service.QuoteCoupon(context.Background(), req)
+	assert.Equal(t, "usage limit reached", err.Error())
+}
+
+func TestReservationLifecycle(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+
+	c := &models.Coupon{
+		CouponCode:           "RESERVE1",
+		ExpiryDate:           now.Add(24 * time.Hour),
+		UsageType:            "single_use",
+		ApplicableCategories: []string{"painkillers"},
+		ValidTimeWindow:      models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
+		DiscountType:         "flat",
+		DiscountValue:        25_00,
+		DiscountTarget:       "total_order_value",
+		MaxUsagePerUser:      1,
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+
+	req := models.ReserveCouponRequest{
+		ValidateCouponRequest: models.ValidateCouponRequest{
+			UserID:     "reserve-user",
+			CouponCode: "RESERVE1",
+			OrderTotal: 200_00,
+			Timestamp:  now,
+			CartItems:  []models.CartItem{{ID: "med001", Category: "painkillers", Price: 200_00}},
+		},
+	}
+
+	first, err := test.Service.ReserveCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+
+	// A parallel checkout cannot take the same use while it is held.
+	_, err = test.Service.ReserveCoupon(context.Background(), req)
+	assert.Equal(t, "usage limit reached", err.Error())
+
+	released, err := test.Service.ReleaseReservation(context.Background(), first.ReservationID)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, models.UsageStatusReleased, released.Status)
+
+	second, err := test.Service.ReserveCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+
+	confirmed, err := test.Service.ConfirmReservation(context.Background(), second.ReservationID, "order-1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, models.UsageStatusConfirmed, confirmed.Status)
+	assert.Equal(t, "order-1", confirmed.OrderID)
+
+	_, err = test.Service.ReleaseReservation(context.Background(), second.ReservationID)
+	assert.Equal(t, true, errors.Is(err, service.ErrReservationState))
+}
+
+func TestReserveCouponIdempotency(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), &models.Coupon{
+		CouponCode:      "RESERVE2",
+		ExpiryDate:      now.Add(24 * time.Hour),
+		UsageType:       "multi_use",
+		ValidTimeWindow: models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
+		DiscountType:    "flat",
+		DiscountValue:   25_00,
+		DiscountTarget:  "total_order_value",
+		MaxUsagePerUser: 1,
+	}))
+
+	req := models.ReserveCouponRequest{
+		ValidateCouponRequest: models.ValidateCouponRequest{
+			UserID:         "reserve-idem-user",
+			CouponCode:     "RESERVE2",
+			OrderTotal:     200_00,
+			Timestamp:      now,
+			CartItems:      []models.CartItem{{ID: "med001", Category: "painkillers", Price: 200_00}},
+			OrderID:        "order-9",
+			IdempotencyKey: "reserve-retry-1",
+		},
+	}
+	first, err := test.Service.ReserveCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+
+	// The retry gets the same hold back rather than hitting the usage limit.
+	replay, err := test.Service.ReserveCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, first.ReservationID, replay.ReservationID)
+
+	// The key belongs to the reservation and cannot be spent on a redemption.
+	_, err = test.Service.ValidateCoupon(context.Background(), req.ValidateCouponRequest)
+	assert.Equal(t, service.ErrIdempotencyKeyReused, err)
+
+	_, err = test.Service.ConfirmReservation(context.Background(), first.ReservationID, "order-other")
+	assert.Equal(t, true, errors.Is(err, service.ErrReservationOrder))
+	confirmed, err := test.Service.ConfirmReservation(context.Background(), first.ReservationID, "order-9")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "order-9", confirmed.OrderID)
+}
+
+func TestReverseUsage(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+
+	c := &models.Coupon{
+		CouponCode:           "REVERSE1",
+		ExpiryDate:           now.Add(24 * time.Hour),
+		UsageType:            "single_use",
+		ApplicableCategories: []string{"painkillers"},
+		ValidTimeWindow:      models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
+		DiscountType:         "flat",
+		DiscountValue:        25_00,
+		DiscountTarget:       "total_order_value",
+		MaxUsagePerUser:      1,
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+
+	req := models.ValidateCouponRequest{
+		UserID:     "reverse-user",
+		CouponCode: "REVERSE1",
+		OrderTotal: 200_00,
+		Timestamp:  now,
+		OrderID:    "order-42",
+		CartItems:  []models.CartItem{{ID: "med001", Category: "painkillers", Price: 200_00}},
+	}
+
+	applied, err := test.Service.ValidateCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, int64(0), applied.UsageID)
+
+	_, err = test.Service.ValidateCoupon(context.Background(), req)
+	assert.Equal(t, "usage limit reached", err.Error())
+
+	reversed, err := test.Service.ReverseUsage(context.Background(), models.ReverseUsageRequest{OrderID: "order-42", Reason: "order cancelled"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(reversed.Reversed))
+	assert.Equal(t, models.UsageStatusReversed, reversed.Reversed[0].Status)
+
+	// The user gets their single use back.
+	req.OrderID = "order-43"
+	_, err = test.Service.ValidateCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+
+	_, err = test.Service.ReverseUsage(context.Background(), models.ReverseUsageRequest{UsageID: 999999, Reason: "refund"})
+	assert.Equal(t, service.ErrUsageNotFound, err)
+}
+
+func TestValidateCouponIdempotency(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+
+	c := &models.Coupon{
+		CouponCode:           "IDEMPOTENT1",
+		ExpiryDate:           now.Add(24 * time.Hour),
+		UsageType:            "multi_use",
+		ApplicableCategories: []string{"painkillers"},
+		ValidTimeWindow:      models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
+		DiscountType:         "flat",
+		DiscountValue:        25_00,
+		DiscountTarget:       "total_order_value",
+		MaxUsagePerUser:      2,
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+
+	req := models.ValidateCouponRequest{
+		UserID:         "idem-user",
+		CouponCode:     "IDEMPOTENT1",
+		OrderTotal:     200_00,
+		Timestamp:      now,
+		CartItems:      []models.CartItem{{ID: "med001", Category: "painkillers", Price: 200_00}},
+		IdempotencyKey: "retry-1",
+	}
+
+	first, err := test.Service.ValidateCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+
+	replay, err := test.Service.ValidateCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, first.UsageID, replay.UsageID)
+
+	// Only one of the two uses was consumed, so a fresh key still works.
+	req.IdempotencyKey = "retry-2"
+	_, err = test.Service.ValidateCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+
+	req.UserID = "someone-else"
+	_, err = test.Service.ValidateCoupon(context.Background(), req)
+	assert.Equal(t, service.ErrIdempotencyKeyReused, err)
+
+	// Retries racing the first request get its response, not a conflict.
+	req.UserID = "racing-user"
+	req.IdempotencyKey = "retry-race"
+	results := make([]models.ValidateCouponResponse, 4)
+	errs := make([]error, len(results))
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = test.Service.ValidateCoupon(context.Background(), req)
+		}(i)
+	}
+	wg.Wait()
+	for i := range results {
+		assert.Equal(t, nil, errs[i])
+		assert.Equal(t, results[0].UsageID, results[i].UsageID)
+	}
+}
+
+func TestUsageTypeSemantics(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+
+	base := models.Coupon{
+		ExpiryDate:           now.Add(24 * time.Hour),
+		ApplicableCategories: []string{"painkillers"},
+		ValidTimeWindow:      models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
+		DiscountType:         "flat",
+		DiscountValue:        25_00,
+		DiscountTarget:       "total_order_value",
+		MaxUsagePerUser:      1,
+	}
+
+	contradictory := base
+	contradictory.CouponCode = "SINGLEBAD"
+	contradictory.UsageType = "single_use"
+	contradictory.MaxUsagePerUser = 3
+	err := test.Service.CreateCoupon(context.Background(), &contradictory)
+	assert.Equal(t, true, errors.Is(err, service.ErrInvalidCoupon))
+
+	single := base
+	single.CouponCode = "SINGLE1"
+	single.UsageType = "single_use"
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), &single))
+
+	shared := base
+	shared.CouponCode = "SHARED1"
+	shared.UsageType = "multi_use"
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), &shared))
+
+	redeem := func(user, code string) error {
+		_, err := test.Service.ValidateCoupon(context.Background(), models.ValidateCouponRequest{
+			UserID:     user,
+			CouponCode: code,
+			OrderTotal: 200_00,
+			Timestamp:  now,
+			CartItems:  []models.CartItem{{ID: "med001", Category: "painkillers", Price: 200_00}},
+		})
+		return err
+	}
+
+	assert.Equal(t, nil, redeem("alice", "SINGLE1"))
+	assert.Equal(t, service.ErrCouponAlreadyRedeemed, redeem("bob", "SINGLE1"))
+
+	assert.Equal(t, nil, redeem("alice", "SHARED1"))
+	assert.Equal(t, nil, redeem("bob", "SHARED1"))
+}
+
+func TestGlobalRedemptionCaps(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+
+	c := &models.Coupon{
+		CouponCode:             "FLAT30",
+		ExpiryDate:             now.Add(24 * time.Hour),
+		UsageType:              "multi_use",
+		ApplicableCategories:   []string{"painkillers"},
+		ValidTimeWindow:        models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
+		DiscountType:           "flat",
+		DiscountValue:          30_00,
+		DiscountTarget:         "total_order_value",
+		MaxUsagePerUser:        1,
+		MaxTotalRedemptions:    3,
+		MaxTotalDiscountBudget: 50_00,
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+
+	redeem := func(user string) (models.ValidateCouponResponse, error) {
+		return test.Service.ValidateCoupon(context.Background(), models.ValidateCouponRequest{
+			UserID:     user,
+			CouponCode: "FLAT30",
+			OrderTotal: 200_00,
+			Timestamp:  now,
+			CartItems:  []models.CartItem{{ID: "med001", Category: "painkillers", Price: 200_00}},
+		})
+	}
+
+	first, err := redeem("user-a")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, models.Money(30_00), first.Discount["total_order_value"])
+
+	// Only 20 of the budget is left for the second redemption.
+	second, err := redeem("user-b")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, models.Money(20_00), second.Discount["total_order_value"])
+
+	_, err = redeem("user-c")
+	assert.Equal(t, service.ErrBudgetExhausted, err)
+
+	stored, err := test.Service.GetCoupon(context.Background(), "FLAT30")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, stored.Redemptions.TotalRedemptions)
+	assert.Equal(t, 1, *stored.Redemptions.RemainingRedemptions)
+	assert.Equal(t, models.Money(0), *stored.Redemptions.RemainingDiscountBudget)
+}
+
+func TestLineItemDiscount(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+
+	c := &models.Coupon{
+		CouponCode:           "VITAMINS20",
+		ExpiryDate:           now.Add(24 * time.Hour),
+		UsageType:            "multi_use",
+		ApplicableCategories: []string{"vitamins"},
+		ValidTimeWindow:      models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
+		DiscountType:         "percentage",
+		DiscountValue:        20_00,
+		DiscountTarget:       "total_order_value",
+		MaxUsagePerUser:      1,
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+
+	quote, err := test.Service.QuoteCoupon(context.Background(), models.ValidateCouponRequest{
+		UserID:     "line-user",
+		CouponCode: "VITAMINS20",
+		OrderTotal: 500_00,
+		Timestamp:  now,
+		CartItems: []models.CartItem{
+			{ID: "vit-c", Category: "vitamins", Price: 100_00},
+			{ID: "insulin", Category: "diabetes", Price: 300_00},
+			{ID: "vit-d", Category: "vitamins", Price: 100_00},
+		},
+	})
+	assert.Equal(t, nil, err)
+
+	// Only the 200 worth of vitamins is discounted, not the whole cart.
+	assert.Equal(t, models.Money(40_00), quote.Discount["total_order_value"])
+	assert.Equal(t, 2, len(quote.LineItems))
+	assert.Equal(t, "vit-c", quote.LineItems[0].MedicineID)
+	assert.Equal(t, models.Money(20_00), quote.LineItems[0].Discount)
+	assert.Equal(t, models.Money(20_00), quote.LineItems[1].Discount)
+}
+
+func TestCartItemQuantity(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+
+	c := &models.Coupon{
+		CouponCode:            "ORS3",
+		ExpiryDate:            now.Add(24 * time.Hour),
+		UsageType:             "multi_use",
+		ApplicableMedicineIDs: []string{"ors"},
+		ValidTimeWindow:       models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
+		DiscountType:          "percentage",
+		DiscountValue:         10_00,
+		DiscountTarget:        "total_order_value",
+		MaxUsagePerUser:       1,
+		MinEligibleUnits:      3,
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+
+	req := models.ValidateCouponRequest{
+		UserID:     "qty-user",
+		CouponCode: "ORS3",
+		OrderTotal: 500_00,
+		Timestamp:  now,
+		CartItems: []models.CartItem{
+			{ID: "ors", Category: "hydration", Price: 20_00, Quantity: 2},
+			{ID: "paracetamol", Category: "painkillers", Price: 50_00, Quantity: 1},
+		},
+	}
+
+	_, err := test.Service.QuoteCoupon(context.Background(), req)
+	assert.Equal(t, service.ErrNotEnoughUnits, err)
+
+	req.CartItems[0].Quantity = 5
+	quote, err := test.Service.QuoteCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, models.Money(10_00), quote.Discount["total_order_value"])
+	assert.Equal(t, 5, quote.LineItems[0].Quantity)
+	assert.Equal(t, models.Money(100_00), quote.LineItems[0].EligibleAmount)
+}
+
+func TestBuyXGetY(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+
+	c := &models.Coupon{
+		CouponCode:            "ORSB2G1",
+		ExpiryDate:            now.Add(24 * time.Hour),
+		UsageType:             "multi_use",
+		ApplicableMedicineIDs: []string{"ors", "ors-orange"},
+		ValidTimeWindow:       models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
+		DiscountType:          models.DiscountTypeBuyXGetY,
+		DiscountValue:         100_00,
+		DiscountTarget:        "total_order_value",
+		BuyXGetY:              &models.BuyXGetY{BuyQuantity: 2, GetQuantity: 1},
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+
+	req := models.ValidateCouponRequest{
+		UserID:     "bogo-user",
+		CouponCode: "ORSB2G1",
+		OrderTotal: 500_00,
+		Timestamp:  now,
+		CartItems: []models.CartItem{
+			{ID: "ors", Category: "hydration", Price: 20_00, Quantity: 2},
+		},
+	}
+
+	_, err := test.Service.QuoteCoupon(context.Background(), req)
+	assert.Equal(t, service.ErrNotEnoughUnits, err)
+
+	// Six eligible units make two complete groups; the cheapest unit of
+	// each group is free.
+	req.CartItems = []models.CartItem{
+		{ID: "ors", Category: "hydration", Price: 20_00, Quantity: 4},
+		{ID: "ors-orange", Category: "hydration", Price: 25_00, Quantity: 2},
+		{ID: "paracetamol", Category: "painkillers", Price: 5_00, Quantity: 3},
+	}
+	quote, err := test.Service.QuoteCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, models.Money(40_00), quote.Discount["total_order_value"])
+	assert.Equal(t, 1, len(quote.FreeUnits))
+	assert.Equal(t, "ors", quote.FreeUnits[0].MedicineID)
+	assert.Equal(t, 2, quote.FreeUnits[0].Quantity)
+	assert.Equal(t, models.Money(40_00), quote.LineItems[0].Discount)
+	assert.Equal(t, models.Money(0_00), quote.LineItems[1].Discount)
+
+	bad := *c
+	bad.CouponCode = "BOGOBAD"
+	bad.BuyXGetY = nil
+	assert.Equal(t, true, errors.Is(test.Service.CreateCoupon(context.Background(), &bad), service.ErrInvalidCoupon))
+}
+
+func TestTieredDiscount(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+
+	c := &models.Coupon{
+		CouponCode:      "SPENDMORE",
+		ExpiryDate:      now.Add(24 * time.Hour),
+		UsageType:       "multi_use",
+		MinOrderValue:   499_00,
+		ValidTimeWindow: models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
+		DiscountType:    "flat",
+		DiscountValue:   50_00,
+		DiscountTarget:  "total_order_value",
+		Tiers: []models.DiscountTier{
+			{Threshold: 999_00, DiscountType: "flat", DiscountValue: 150_00},
+			{Threshold: 1999_00, DiscountType: "percentage", DiscountValue: 15_00},
+		},
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+
+	req := models.ValidateCouponRequest{
+		UserID:     "tier-user",
+		CouponCode: "SPENDMORE",
+		OrderTotal: 600_00,
+		Timestamp:  now,
+		CartItems:  []models.CartItem{{ID: "med1", Category: "wellness", Price: 600_00}},
+	}
+	quote, err := test.Service.QuoteCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, models.Money(50_00), quote.Discount["total_order_value"])
+	assert.Equal(t, true, quote.Tier == nil)
+
+	req.OrderTotal, req.CartItems[0].Price = 2400_00, 2400_00
+	quote, err = test.Service.QuoteCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, models.Money(360_00), quote.Discount["total_order_value"])
+	assert.Equal(t, models.Money(1999_00), quote.Tier.Threshold)
+
+	coupons, err := test.Service.GetApplicableCoupons(context.Background(), models.ApplicableCouponsRequest{
+		OrderTotal: 900_00,
+		Timestamp:  now,
+		CartItems:  []models.CartItem{{ID: "med1", Category: "wellness", Price: 900_00}},
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(coupons.Applicable))
+	assert.Equal(t, models.Money(999_00), coupons.Applicable[0].NextTier.Threshold)
+	assert.Equal(t, models.Money(99_00), coupons.Applicable[0].NextTier.AmountNeeded)
+
+	bad := *c
+	bad.CouponCode = "BADTIERS"
+	bad.Tiers = []models.DiscountTier{{Threshold: 400_00, DiscountType: "flat", DiscountValue: 10_00}}
+	assert.Equal(t, true, errors.Is(test.Service.CreateCoupon(context.Background(), &bad), service.ErrInvalidCoupon))
+}
+
+func TestDeliveryDiscount(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+
+	window := models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)}
+	half := &models.Coupon{
+		CouponCode:      "HALFSHIP",
+		ExpiryDate:      now.Add(24 * time.Hour),
+		UsageType:       "multi_use",
+		ValidTimeWindow: window,
+		DiscountType:    "percentage",
+		DiscountValue:   50_00,
+		DiscountTarget:  "delivery",
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), half))
+
+	free := &models.Coupon{
+		CouponCode:              "FREESHIP",
+		ExpiryDate:              now.Add(24 * time.Hour),
+		UsageType:               "multi_use",
+		ValidTimeWindow:         window,
+		DiscountType:            models.DiscountTypeFreeDelivery,
+		DiscountTarget:          "delivery",
+		ApplicableDeliveryTypes: []string{"standard"},
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), free))
+
+	req := models.ValidateCouponRequest{
+		UserID:       "ship-user",
+		CouponCode:   "HALFSHIP",
+		OrderTotal:   1000_00,
+		DeliveryFee:  40_00,
+		DeliveryType: "express",
+		Timestamp:    now,
+		CartItems:    []models.CartItem{{ID: "med1", Category: "wellness", Price: 1000_00}},
+	}
+	quote, err := test.Service.QuoteCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, models.Money(20_00), quote.Discount["delivery"])
+
+	req.CouponCode = "FREESHIP"
+	_, err = test.Service.QuoteCoupon(context.Background(), req)
+	assert.Equal(t, service.ErrDeliveryNotApplicable, err)
+
+	req.DeliveryType = "standard"
+	quote, err = test.Service.QuoteCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, models.Money(40_00), quote.Discount["delivery"])
+
+	req.DeliveryFee = 0
+	_, err = test.Service.QuoteCoupon(context.Background(), req)
+	assert.Equal(t, service.ErrDeliveryNotApplicable, err)
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var item models.CartItem
+	assert.Equal(t, nil, json.Unmarshal([]byte(`{"medicine_id":"m1","category":"c","price":249.99}`), &item))
+	assert.Equal(t, models.Money(249_99), item.Price)
+
+	out, err := json.Marshal(models.Money(249_90))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "249.90", string(out))
+
+	assert.NotEqual(t, nil, json.Unmarshal([]byte(`{"price":1.005}`), &item))
+
+	for _, bad := range []string{"1.-5", "1.+5", "--5", "-+5", "1e3", "1.5x", ".", "184467440737095516.17", "92233720368547758.08"} {
+		_, err := models.ParseMoney(bad)
+		assert.NotEqual(t, nil, err)
+	}
+	m, err := models.ParseMoney("-.5")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, models.Money(-50), m)
+	m, err = models.ParseMoney("92233720368547758.07")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, models.Money(math.MaxInt64), m)
+}
+
+func TestRoundingMode(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+
+	req := models.ValidateCouponRequest{
+		UserID:     "round-user",
+		OrderTotal: 99_99,
+		Timestamp:  now,
+		CartItems:  []models.CartItem{{ID: "med1", Category: "wellness", Price: 99_99}},
+	}
+
+	cases := []struct {
+		code string
+		mode models.RoundingMode
+		unit models.Money
+		want models.Money
+	}{
+		{"ROUNDPAISA", models.RoundingModeHalfUp, 0, 12_50}, // 12.49875
+		{"ROUNDFLOOR", models.RoundingModeFloor, 1_00, 12_00},
+		{"ROUNDCEIL", models.RoundingModeCeil, 1_00, 13_00},
+	}
+	for _, tc := range cases {
+		c := &models.Coupon{
+			CouponCode:      tc.code,
+			ExpiryDate:      now.Add(24 * time.Hour),
+			UsageType:       "multi_use",
+			ValidTimeWindow: models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
+			DiscountType:    "percentage",
+			DiscountValue:   12_50,
+			DiscountTarget:  "total_order_value",
+			RoundingMode:    tc.mode,
+			RoundingUnit:    tc.unit,
+		}
+		assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+
+		req.CouponCode = tc.code
+		quote, err := test.Service.QuoteCoupon(context.Background(), req)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, tc.want, quote.Discount["total_order_value"])
+	}
+}
+
+func TestCurrency(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+
+	rates, err := service.NewStaticRateProvider("INR", map[string]string{"USD": "80"})
+	assert.Equal(t, nil, err)
+	test.Service.Rates = rates
+
+	window := models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)}
+	local := &models.Coupon{
+		CouponCode:      "INRONLY",
+		ExpiryDate:      now.Add(24 * time.Hour),
+		UsageType:       "multi_use",
+		ValidTimeWindow: window,
+		DiscountType:    "flat",
+		DiscountValue:   400_00,
+		DiscountTarget:  "total_order_value",
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), local))
+	assert.Equal(t, "INR", local.Currency)
+
+	global := *local
+	global.CouponCode = "ANYCURRENCY"
+	global.MinOrderValue = 800_00
+	global.AllowCrossCurrency = true
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), &global))
+
+	req := models.ValidateCouponRequest{
+		UserID:     "usd-user",
+		CouponCode: "INRONLY",
+		OrderTotal: 50_00,
+		Currency:   "USD",
+		Timestamp:  now,
+		CartItems:  []models.CartItem{{ID: "med1", Category: "wellness", Price: 50_00}},
+	}
+	_, err = test.Service.QuoteCoupon(context.Background(), req)
+	assert.Equal(t, service.ErrCurrencyMismatch, err)
+
+	// ₹400 off is $5 off, and the ₹800 minimum is $10.
+	req.CouponCode = "ANYCURRENCY"
+	quote, err := test.Service.QuoteCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "USD", quote.Currency)
+	assert.Equal(t, models.Money(5_00), quote.Discount["total_order_value"])
+
+	req.OrderTotal, req.CartItems[0].Price = 9_00, 9_00
+	_, err = test.Service.QuoteCoupon(context.Background(), req)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestExclusions(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+
+	c := &models.Coupon{
+		CouponCode:          "ALLBUTINSULIN",
+		ExpiryDate:          now.Add(24 * time.Hour),
+		UsageType:           "multi_use",
+		ExcludedMedicineIDs: []string{"insulin"},
+		ExcludedCategories:  []string{"baby_formula"},
+		ValidTimeWindow:     models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
+		DiscountType:        "percentage",
+		DiscountValue:       10_00,
+		DiscountTarget:      "total_order_value",
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+
+	req := models.ValidateCouponRequest{
+		UserID:     "excl-user",
+		CouponCode: "ALLBUTINSULIN",
+		OrderTotal: 1000_00,
+		Timestamp:  now,
+		CartItems: []models.CartItem{
+			{ID: "insulin", Category: "diabetes", Price: 500_00},
+			{ID: "formula", Category: "baby_formula", Price: 300_00},
+			{ID: "vit-c", Category: "vitamins", Price: 200_00},
+		},
+	}
+	quote, err := test.Service.QuoteCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, models.Money(20_00), quote.Discount["total_order_value"])
+	assert.Equal(t, 1, len(quote.LineItems))
+
+	onlyExcluded := models.ApplicableCouponsRequest{
+		OrderTotal: 800_00,
+		Timestamp:  now,
+		CartItems:  req.CartItems[:2],
+	}
+	coupons, err := test.Service.GetApplicableCoupons(context.Background(), onlyExcluded)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(coupons.Applicable))
+
+	req.CartItems = req.CartItems[:2]
+	_, err = test.Service.QuoteCoupon(context.Background(), req)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestRecurringSchedule(t *testing.T) {
+	test := setupTest(t)
+
+	ist, err := time.LoadLocation("Asia/Kolkata")
+	assert.Equal(t, nil, err)
+	// Wednesday 7pm in Kolkata.
+	evening := time.Date(2030, time.January, 2, 19, 0, 0, 0, ist)
+	test.Service.Clock = service.FixedClock{Time: evening}
+
+	c := &models.Coupon{
+		CouponCode:      "HAPPYHOUR",
+		ExpiryDate:      evening.AddDate(0, 1, 0),
+		UsageType:       "multi_use",
+		ValidTimeWindow: models.TimeWindow{Start: evening.AddDate(0, 0, -7), End: evening.AddDate(0, 1, 0)},
+		Schedule: &models.RecurringSchedule{
+			Timezone:      "Asia/Kolkata",
+			DaysOfWeek:    []string{"mon", "tue", "wed", "thu", "fri"},
+			HourWindows:   []models.HourWindow{{Start: "18:00", End: "21:00"}},
+			BlackoutDates: []string{"2030-01-03"},
+		},
+		DiscountType:   "flat",
+		DiscountValue:  30_00,
+		DiscountTarget: "total_order_value",
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+
+	req := models.ValidateCouponRequest{
+		UserID:     "sched-user",
+		CouponCode: "HAPPYHOUR",
+		OrderTotal: 300_00,
+		Timestamp:  evening.UTC(),
+		CartItems:  []models.CartItem{{ID: "med1", Category: "wellness", Price: 300_00}},
+	}
+	_, err = test.Service.QuoteCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+
+	for _, ts := range []time.Time{
+		evening.Add(3 * time.Hour), // 10pm, after the window
+		evening.AddDate(0, 0, 1),   // blackout date
+		evening.AddDate(0, 0, 3),   // Saturday
+	} {
+		test.Service.Clock = service.FixedClock{Time: ts}
+		req.Timestamp = ts
+		_, err = test.Service.QuoteCoupon(context.Background(), req)
+		assert.Equal(t, service.ErrOutsideSchedule, err)
+	}
+
+	coupons, err := test.Service.GetApplicableCoupons(context.Background(), models.ApplicableCouponsRequest{
+		OrderTotal: 300_00,
+		Timestamp:  evening.AddDate(0, 0, 3),
+		CartItems:  req.CartItems,
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(coupons.Applicable))
+	assert.Equal(t, models.IneligibleOutsideSchedule, coupons.Ineligible[0].Reason)
+
+	bad := *c
+	bad.CouponCode = "BADZONE"
+	bad.Schedule = &models.RecurringSchedule{Timezone: "Mars/Olympus"}
+	assert.Equal(t, true, errors.Is(test.Service.CreateCoupon(context.Background(), &bad), service.ErrInvalidCoupon))
+
+	// A Friday night window runs into Saturday morning, not Friday morning.
+	late := *c
+	late.CouponCode = "FRIDAYLATE"
+	late.Schedule = &models.RecurringSchedule{
+		Timezone:    "Asia/Kolkata",
+		DaysOfWeek:  []string{"fri"},
+		HourWindows: []models.HourWindow{{Start: "22:00", End: "02:00"}},
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), &late))
+	req.CouponCode = "FRIDAYLATE"
+	for ts, want := range map[time.Time]error{
+		time.Date(2030, time.January, 4, 23, 0, 0, 0, ist): nil,                        // Friday 11pm
+		time.Date(2030, time.January, 5, 1, 0, 0, 0, ist):  nil,                        // Saturday 1am
+		time.Date(2030, time.January, 4, 1, 0, 0, 0, ist):  service.ErrOutsideSchedule, // Friday 1am
+	} {
+		test.Service.Clock = service.FixedClock{Time: ts}
+		req.Timestamp = ts
+		_, err = test.Service.QuoteCoupon(context.Background(), req)
+		assert.Equal(t, want, err)
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	test := setupTest(t)
+	now := time.Date(2030, time.March, 1, 12, 0, 0, 0, time.UTC)
+	test.Service.Clock = service.FixedClock{Time: now}
+
+	c := &models.Coupon{
+		CouponCode:      "NOBACKDATING",
+		ExpiryDate:      now.Add(24 * time.Hour),
+		UsageType:       "multi_use",
+		ValidTimeWindow: models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
+		DiscountType:    "flat",
+		DiscountValue:   10_00,
+		DiscountTarget:  "total_order_value",
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+
+	req := models.ValidateCouponRequest{
+		UserID:     "skew-user",
+		CouponCode: "NOBACKDATING",
+		OrderTotal: 100_00,
+		Timestamp:  now.Add(2 * time.Minute),
+		CartItems:  []models.CartItem{{ID: "med1", Category: "wellness", Price: 100_00}},
+	}
+	resp, err := test.Service.QuoteCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, resp.ClockSkew)
+
+	// Once the coupon has expired, an old client timestamp is not enough
+	// to redeem it.
+	test.Service.Clock = service.FixedClock{Time: now.Add(48 * time.Hour)}
+	req.Timestamp = now
+	_, err = test.Service.ValidateCoupon(context.Background(), req)
+	assert.NotEqual(t, nil, err)
+
+	// Without a timestamp the server clock is used and nothing is flagged.
+	test.Service.Clock = service.FixedClock{Time: now}
+	req.Timestamp = time.Time{}
+	resp, err = test.Service.ValidateCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, resp.ClockSkew)
+
+	req.Timestamp = now.Add(-1 * time.Hour)
+	resp, err = test.Service.ValidateCoupon(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, resp.ClockSkew)
+}
+
+func TestSegmentRules(t *testing.T) {
+	test := setupTest(t)
+	now := time.Date(2030, time.April, 1, 12, 0, 0, 0, time.UTC)
+	test.Service.Clock = service.FixedClock{Time: now}
+
+	lastMonth := now.AddDate(0, -1, 0)
+	lastWeek := now.AddDate(0, 0, -7)
+	profiles := service.NewInMemoryUserProfiles(
+		models.UserProfile{UserID: "regular", OrderCount: 12, LastOrderAt: &lastWeek},
+		models.UserProfile{UserID: "lapsed", OrderCount: 3, LastOrderAt: &lastMonth},
+		models.UserProfile{UserID: "chronic", OrderCount: 8, LastOrderAt: &lastWeek, Segments: []string{"chronic_care"}},
+	)
+	test.Service.Profiles = profiles
+
+	noPrior := 0
+	coupons := map[string]*models.SegmentRules{
+		"WELCOME":  {FirstOrderOnly: true},
+		"COMEBACK": {MinDaysSinceLastOrder: 21},
+		"CHRONIC":  {RequiredSegments: []string{"chronic_care"}},
+		"NEWISH":   {MaxPriorOrders: &noPrior},
+	}
+	for code, rules := range coupons {
+		assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), &models.Coupon{
+			CouponCode:      code,
+			ExpiryDate:      now.AddDate(0, 1, 0),
+			UsageType:       "multi_use",
+			ValidTimeWindow: models.TimeWindow{Start: now.Add(-time.Hour), End: now.AddDate(0, 1, 0)},
+			SegmentRules:    rules,
+			DiscountType:    "flat",
+			DiscountValue:   50_00,
+			DiscountTarget:  "total_order_value",
+		}))
+	}
+
+	cases := []struct {
+		code, user string
+		ok         bool
+	}{
+		{"WELCOME", "newcomer", true},
+		{"WELCOME", "regular", false},
+		{"NEWISH", "newcomer", true},
+		{"NEWISH", "lapsed", false},
+		{"COMEBACK", "lapsed", true},
+		{"COMEBACK", "regular", false},
+		{"COMEBACK", "newcomer", false},
+		{"CHRONIC", "chronic", true},
+		{"CHRONIC", "regular", false},
+	}
+	for _, tc := range cases {
+		_, err := test.Service.QuoteCoupon(context.Background(), models.ValidateCouponRequest{
+			UserID:     tc.user,
+			CouponCode: tc.code,
+			OrderTotal: 500_00,
+			Timestamp:  now,
+			CartItems:  []models.CartItem{{ID: "med1", Category: "diabetes", Price: 500_00}},
+		})
+		if tc.ok {
+			assert.Equal(t, nil, err)
+		} else {
+			assert.Equal(t, service.ErrSegmentNotEligible, err)
+		}
+	}
+
+	// A segment granted later takes effect on the next check.
+	profiles.Set(models.UserProfile{UserID: "regular", OrderCount: 12, LastOrderAt: &lastWeek, Segments: []string{"chronic_care"}})
+	_, err := test.Service.QuoteCoupon(context.Background(), models.ValidateCouponRequest{
+		UserID:     "regular",
+		CouponCode: "CHRONIC",
+		OrderTotal: 500_00,
+		Timestamp:  now,
+		CartItems:  []models.CartItem{{ID: "med1", Category: "diabetes", Price: 500_00}},
+	})
+	assert.Equal(t, nil, err)
+
+	// The Postgres provider treats an unknown user as a new customer.
+	pgProfiles := repository.NewUserProfileRepository(test.Repo.DBHelper)
+	assert.Equal(t, nil, pgProfiles.SaveUserProfile(context.Background(), models.UserProfile{UserID: "stored", OrderCount: 2, Segments: []string{"vip"}}))
+	stored, err := pgProfiles.GetUserProfile(context.Background(), "stored")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, stored.OrderCount)
+	assert.Equal(t, []string{"vip"}, stored.Segments)
+	unknown, err := pgProfiles.GetUserProfile(context.Background(), "nobody")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, unknown.OrderCount)
+}
+
+func TestCouponStacking(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+	window := models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)}
+
+	for _, c := range []*models.Coupon{
+		{CouponCode: "FREESHIP", DiscountType: models.DiscountTypeFreeDelivery, DiscountTarget: "delivery", StackingGroup: "delivery", Precedence: 1},
+		{CouponCode: "FLAT100", DiscountType: "flat", DiscountValue: 100_00, DiscountTarget: "total_order_value", StackingGroup: "order", Precedence: 2},
+		{CouponCode: "PCT20", DiscountType: "percentage", DiscountValue: 20_00, DiscountTarget: "total_order_value", StackingGroup: "order", Precedence: 3},
+		{CouponCode: "SOLO", DiscountType: "flat", DiscountValue: 300_00, DiscountTarget: "total_order_value", Exclusive: true, Precedence: 5},
+	} {
+		c.ExpiryDate = now.Add(24 * time.Hour)
+		c.UsageType = "multi_use"
+		c.ValidTimeWindow = window
+		assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+	}
+
+	req := models.StackCouponsRequest{
+		UserID:      "stack-user",
+		CouponCodes: []string{"PCT20", "FREESHIP", "FLAT100", "SOLO", "MISSING"},
+		OrderTotal:  1000_00,
+		DeliveryFee: 40_00,
+		Timestamp:   now,
+		CartItems:   []models.CartItem{{ID: "med1", Category: "wellness", Price: 1000_00}},
+	}
+	quote, err := test.Service.QuoteStack(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, quote.IsValid)
+	assert.Equal(t, models.Money(140_00), quote.TotalDiscount)
+	assert.Equal(t, models.Money(40_00), quote.Discount["delivery"])
+	assert.Equal(t, models.Money(100_00), quote.Discount["total_order_value"])
+
+	// The breakdown follows the request order; FLAT100 beats PCT20 on precedence.
+	assert.Equal(t, 5, len(quote.Coupons))
+	assert.Equal(t, "PCT20", quote.Coupons[0].CouponCode)
+	assert.Equal(t, false, quote.Coupons[0].Applied)
+	assert.Equal(t, "a coupon from the same stacking group is already applied: FLAT100 is in group order", quote.Coupons[0].Reason)
+	assert.Equal(t, true, quote.Coupons[1].Applied)
+	assert.Equal(t, true, quote.Coupons[2].Applied)
+	assert.Equal(t, "coupon cannot be combined with other coupons: SOLO is exclusive", quote.Coupons[3].Reason)
+	assert.Equal(t, "coupon not found", quote.Coupons[4].Reason)
+
+	// Taken alone, an exclusive coupon still applies.
+	solo, err := test.Service.QuoteStack(context.Background(), models.StackCouponsRequest{
+		UserID:      "stack-user",
+		CouponCodes: []string{"SOLO"},
+		OrderTotal:  req.OrderTotal,
+		Timestamp:   now,
+		CartItems:   req.CartItems,
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, models.Money(300_00), solo.TotalDiscount)
+
+	// A 10% combined cap leaves 100.00 for the whole stack.
+	test.Service.MaxCombinedDiscountPercent = 10_00
+	resp, err := test.Service.RedeemStack(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, models.Money(100_00), resp.TotalDiscount)
+	assert.Equal(t, models.Money(40_00), resp.Coupons[1].Discount["delivery"])
+	assert.Equal(t, models.Money(60_00), resp.Coupons[2].Discount["total_order_value"])
+	assert.NotEqual(t, int64(0), resp.Coupons[2].UsageID)
+	assert.Equal(t, int64(0), resp.Coupons[0].UsageID)
+
+	flat, err := test.Service.GetCoupon(context.Background(), "FLAT100")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, flat.Redemptions.TotalRedemptions)
+	assert.Equal(t, models.Money(60_00), flat.Redemptions.TotalDiscountGiven)
+	pct, err := test.Service.GetCoupon(context.Background(), "PCT20")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, pct.Redemptions.TotalRedemptions)
+
+	// Redeeming codes one at a time against an order meets the same rules.
+	test.Service.MaxCombinedDiscountPercent = 0
+	single := req.ForCoupon("SOLO")
+	single.OrderID = "order-solo"
+	_, err = test.Service.ValidateCoupon(context.Background(), single)
+	assert.Equal(t, nil, err)
+	single.CouponCode = "FREESHIP"
+	_, err = test.Service.ValidateCoupon(context.Background(), single)
+	assert.Equal(t, true, errors.Is(err, service.ErrCouponNotStackable))
+
+	single = req.ForCoupon("FLAT100")
+	single.OrderID = "order-group"
+	_, err = test.Service.ValidateCoupon(context.Background(), single)
+	assert.Equal(t, nil, err)
+	single.CouponCode = "PCT20"
+	_, err = test.Service.ValidateCoupon(context.Background(), single)
+	assert.Equal(t, true, errors.Is(err, service.ErrStackingGroupConflict))
+	single.CouponCode = "FREESHIP"
+	_, err = test.Service.ValidateCoupon(context.Background(), single)
+	assert.Equal(t, nil, err)
+}
+
+func TestRedeemStackIdempotency(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), &models.Coupon{
+		CouponCode:      "STACKONCE",
+		ExpiryDate:      now.Add(24 * time.Hour),
+		UsageType:       "multi_use",
+		ValidTimeWindow: models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
+		DiscountType:    "flat",
+		DiscountValue:   50_00,
+		DiscountTarget:  "total_order_value",
+		MaxUsagePerUser: 2,
+	}))
+
+	req := models.StackCouponsRequest{
+		UserID:         "stack-idem-user",
+		CouponCodes:    []string{"STACKONCE"},
+		OrderTotal:     500_00,
+		Timestamp:      now,
+		CartItems:      []models.CartItem{{ID: "med1", Category: "wellness", Price: 500_00}},
+		IdempotencyKey: "stack-retry-1",
+	}
+	first, err := test.Service.RedeemStack(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, first.IsValid)
+
+	replay, err := test.Service.RedeemStack(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, first.Coupons[0].UsageID, replay.Coupons[0].UsageID)
+
+	coupon, err := test.Service.GetCoupon(context.Background(), "STACKONCE")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, coupon.Redemptions.TotalRedemptions)
+
+	req.CouponCodes = []string{"STACKONCE", "OTHER"}
+	_, err = test.Service.RedeemStack(context.Background(), req)
+	assert.Equal(t, service.ErrIdempotencyKeyReused, err)
+}
+
+func TestBestCoupons(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+	window := models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)}
+
+	for _, c := range []*models.Coupon{
+		{CouponCode: "FREESHIP", DiscountType: models.DiscountTypeFreeDelivery, DiscountTarget: "delivery", StackingGroup: "delivery", Precedence: 1},
+		{CouponCode: "FLAT100", DiscountType: "flat", DiscountValue: 100_00, DiscountTarget: "total_order_value", StackingGroup: "order", Precedence: 2},
+		{CouponCode: "PCT20", DiscountType: "percentage", DiscountValue: 20_00, DiscountTarget: "total_order_value", StackingGroup: "order", Precedence: 3},
+		{CouponCode: "SOLO", DiscountType: "flat", DiscountValue: 250_00, DiscountTarget: "total_order_value", Exclusive: true, Precedence: 5},
+		{CouponCode: "BIGCART", DiscountType: "flat", DiscountValue: 500_00, DiscountTarget: "total_order_value", MinOrderValue: 5000_00},
+	} {
+		c.ExpiryDate = now.Add(24 * time.Hour)
+		c.UsageType = "multi_use"
+		c.ValidTimeWindow = window
+		assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+	}
+
+	req := models.ApplicableCouponsRequest{
+		OrderTotal:  1000_00,
+		DeliveryFee: 40_00,
+		Timestamp:   now,
+		CartItems:   []models.CartItem{{ID: "med1", Category: "wellness", Price: 1000_00}},
+	}
+	best, err := test.Service.BestCoupons(context.Background(), req)
+	assert.Equal(t, nil, err)
+
+	type ranked struct {
+		codes  []string
+		saving models.Money
+	}
+	var got []ranked
+	for _, option := range best.Options {
+		got = append(got, ranked{option.CouponCodes, option.TotalDiscount})
+	}
+	assert.Equal(t, []ranked{
+		{[]string{"SOLO"}, 250_00},
+		{[]string{"FREESHIP", "PCT20"}, 240_00},
+		{[]string{"PCT20"}, 200_00},
+		{[]string{"FREESHIP", "FLAT100"}, 140_00},
+		{[]string{"FLAT100"}, 100_00},
+		{[]string{"FREESHIP"}, 40_00},
+	}, got)
+	assert.Equal(t, true, best.Options[0].Recommended)
+	assert.Equal(t, false, best.Options[1].Recommended)
+
+	assert.Equal(t, false, best.Truncated)
+
+	// The combined cap trims coupons used alone as well as stacks, as the
+	// stack redeem endpoint does.
+	test.Service.MaxCombinedDiscountPercent = 15_00
+	best, err = test.Service.BestCoupons(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"PCT20"}, best.Options[0].CouponCodes)
+	assert.Equal(t, models.Money(150_00), best.Options[0].TotalDiscount)
+	assert.Equal(t, []string{"SOLO"}, best.Options[1].CouponCodes)
+	assert.Equal(t, models.Money(150_00), best.Options[1].TotalDiscount)
+	assert.Equal(t, []string{"FREESHIP", "PCT20"}, best.Options[2].CouponCodes)
+	assert.Equal(t, models.Money(150_00), best.Options[2].TotalDiscount)
+	assert.Equal(t, models.Money(110_00), best.Options[2].Coupons[1].Discount["total_order_value"])
+
+	// A nearly spent budget is ranked on what is left of it.
+	test.Service.MaxCombinedDiscountPercent = 0
+	budget := &models.Coupon{
+		CouponCode:             "BUDGETSOLO",
+		ExpiryDate:             now.Add(24 * time.Hour),
+		UsageType:              "multi_use",
+		ValidTimeWindow:        window,
+		DiscountType:           "flat",
+		DiscountValue:          300_00,
+		DiscountTarget:         "total_order_value",
+		Exclusive:              true,
+		MaxTotalDiscountBudget: 350_00,
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), budget))
+	_, err = test.Service.ValidateCoupon(context.Background(), models.ValidateCouponRequest{
+		UserID: "someone", CouponCode: "BUDGETSOLO", OrderTotal: 1000_00, Timestamp: now, CartItems: req.CartItems,
+	})
+	assert.Equal(t, nil, err)
+
+	best, err = test.Service.BestCoupons(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"SOLO"}, best.Options[0].CouponCodes)
+	assert.Equal(t, []string{"BUDGETSOLO"}, best.Options[5].CouponCodes)
+	assert.Equal(t, models.Money(50_00), best.Options[5].TotalDiscount)
+
+	// Too many stackable coupons to price every combination.
+	for i := 0; i < 11; i++ {
+		assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), &models.Coupon{
+			CouponCode:      fmt.Sprintf("MANY%02d", i),
+			ExpiryDate:      now.Add(24 * time.Hour),
+			UsageType:       "multi_use",
+			ValidTimeWindow: window,
+			DiscountType:    "flat",
+			DiscountValue:   1_00,
+			DiscountTarget:  "total_order_value",
+		}))
+	}
+	best, err = test.Service.BestCoupons(context.Background(), req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, best.Truncated)
+}
+
+func TestApplicableCouponsPreview(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+	window := models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)}
+
+	for _, c := range []*models.Coupon{
+		{CouponCode: "PCT10", DiscountType: "percentage", DiscountValue: 10_00, MaxDiscountAmount: 150_00},
+		{CouponCode: "FLAT120", DiscountType: "flat", DiscountValue: 120_00, MinOrderValue: 1300_00},
+		{CouponCode: "SHIPONLY", DiscountType: "flat", DiscountValue: 20_00, MinOrderValue: 100_00},
+		{CouponCode: "ONCE", DiscountType: "flat", DiscountValue: 50_00, UsageType: "single_use"},
+	} {
+		c.ExpiryDate = now.Add(24 * time.Hour)
+		c.DiscountTarget = "total_order_value"
+		c.ValidTimeWindow = window
+		if c.UsageType == "" {
+			c.UsageType = "multi_use"
+		}
+		if c.CouponCode == "SHIPONLY" {
+			c.DiscountTarget = "delivery"
+		}
+		assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+	}
+
+	cart := []models.CartItem{{ID: "med1", Category: "wellness", Price: 1220_00}}
+	_, err := test.Service.ValidateCoupon(context.Background(), models.ValidateCouponRequest{
+		UserID: "someone", CouponCode: "ONCE", OrderTotal: 1220_00, Timestamp: now, CartItems: cart,
+	})
+	assert.Equal(t, nil, err)
+
+	resp, err := test.Service.GetApplicableCoupons(context.Background(), models.ApplicableCouponsRequest{
+		OrderTotal: 1220_00,
+		Timestamp:  now,
+		CartItems:  cart,
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "INR", resp.Currency)
+
+	assert.Equal(t, 1, len(resp.Applicable))
+	assert.Equal(t, "PCT10", resp.Applicable[0].CouponCode)
+	assert.Equal(t, models.Money(122_00), resp.Applicable[0].TotalDiscount)
+	assert.Equal(t, models.Money(28_00), *resp.Applicable[0].Headroom)
+
+	reasons := make(map[string]models.IneligibleCoupon)
+	for _, c := range resp.Ineligible {
+		reasons[c.CouponCode] = c
+	}
+	assert.Equal(t, 2, len(reasons))
+	assert.Equal(t, models.IneligibleBelowMinOrder, reasons["FLAT120"].Reason)
+	assert.Equal(t, models.Money(80_00), *reasons["FLAT120"].AmountNeeded)
+	assert.Equal(t, models.IneligibleDeliveryNotApplicable, reasons["SHIPONLY"].Reason)
+
+	// A spent single-use code is not listed for anyone to find.
+	_, listed := reasons["ONCE"]
+	assert.Equal(t, false, listed)
+
+	// The preview is held to what is left of the budget, as redeeming is.
+	budget := &models.Coupon{
+		CouponCode:             "BUDGET150",
+		ExpiryDate:             now.Add(24 * time.Hour),
+		UsageType:              "multi_use",
+		ValidTimeWindow:        window,
+		DiscountType:           "flat",
+		DiscountValue:          100_00,
+		DiscountTarget:         "total_order_value",
+		MaxTotalDiscountBudget: 150_00,
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), budget))
+	_, err = test.Service.ValidateCoupon(context.Background(), models.ValidateCouponRequest{
+		UserID: "someone", CouponCode: "BUDGET150", OrderTotal: 1220_00, Timestamp: now, CartItems: cart,
+	})
+	assert.Equal(t, nil, err)
+
+	resp, err = test.Service.GetApplicableCoupons(context.Background(), models.ApplicableCouponsRequest{
+		OrderTotal: 1220_00,
+		Timestamp:  now,
+		CartItems:  cart,
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(resp.Applicable))
+	assert.Equal(t, "BUDGET150", resp.Applicable[1].CouponCode)
+	assert.Equal(t, models.Money(50_00), resp.Applicable[1].TotalDiscount)
+}
+
+func TestApplicableCouponsForUser(t *testing.T) {
+	test := setupTest(t)
+	now := time.Date(2030, time.May, 1, 12, 0, 0, 0, time.UTC)
+	test.Service.Clock = service.FixedClock{Time: now}
+	test.Service.Profiles = service.NewInMemoryUserProfiles(models.UserProfile{UserID: "returning", OrderCount: 4})
+
+	for _, c := range []*models.Coupon{
+		{CouponCode: "TWICE", MaxUsagePerUser: 1, ValidTimeWindow: models.TimeWindow{Start: now.Add(-time.Hour), End: now.Add(time.Hour)}},
+		{CouponCode: "LATER", ValidTimeWindow: models.TimeWindow{Start: now.Add(time.Hour), End: now.Add(3 * time.Hour)}},
+		{CouponCode: "WELCOME", SegmentRules: &models.SegmentRules{FirstOrderOnly: true}, ValidTimeWindow: models.TimeWindow{Start: now.Add(-time.Hour), End: now.Add(time.Hour)}},
+	} {
+		c.ExpiryDate = now.Add(24 * time.Hour)
+		c.UsageType = "multi_use"
+		c.DiscountType = "flat"
+		c.DiscountValue = 25_00
+		c.DiscountTarget = "total_order_value"
+		assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+	}
+
+	cart := []models.CartItem{{ID: "med1", Category: "wellness", Price: 400_00}}
+	_, err := test.Service.ValidateCoupon(context.Background(), models.ValidateCouponRequest{
+		UserID: "returning", CouponCode: "TWICE", OrderTotal: 400_00, Timestamp: now, CartItems: cart,
+	})
+	assert.Equal(t, nil, err)
+
+	req := models.ApplicableCouponsRequest{OrderTotal: 400_00, Timestamp: now, CartItems: cart}
+	reasonsFor := func(userID string) (applicable []string, reasons map[string]models.IneligibleReason) {
+		req.UserID = userID
+		resp, err := test.Service.GetApplicableCoupons(context.Background(), req)
+		assert.Equal(t, nil, err)
+		reasons = make(map[string]models.IneligibleReason)
+		for _, c := range resp.Applicable {
+			applicable = append(applicable, c.CouponCode)
+		}
+		for _, c := range resp.Ineligible {
+			reasons[c.CouponCode] = c.Reason
+		}
+		return applicable, reasons
+	}
+
+	// Without a user only the coupon-wide rules apply, and targeted coupons
+	// are not shown at all.
+	applicable, reasons := reasonsFor("")
+	assert.Equal(t, []string{"TWICE"}, applicable)
+	assert.Equal(t, models.IneligibleOutsideTimeWindow, reasons["LATER"])
+	_, listed := reasons["WELCOME"]
+	assert.Equal(t, false, listed)
+
+	// Nor is a coupon for a segment the user is not in.
+	applicable, reasons = reasonsFor("returning")
+	assert.Equal(t, 0, len(applicable))
+	assert.Equal(t, models.IneligibleUsageLimitReached, reasons["TWICE"])
+	assert.Equal(t, models.IneligibleOutsideTimeWindow, reasons["LATER"])
+	_, listed = reasons["WELCOME"]
+	assert.Equal(t, false, listed)
+
+	applicable, _ = reasonsFor("newcomer")
+	assert.Equal(t, 2, len(applicable))
+}
+
+func TestErrorCodes(t *testing.T) {
+	test := setupTest(t)
+	now := time.Now()
+
+	c := &models.Coupon{
+		CouponCode:      "CODES",
+		ExpiryDate:      now.Add(24 * time.Hour),
+		UsageType:       "multi_use",
+		MinOrderValue:   500_00,
+		ValidTimeWindow: models.TimeWindow{Start: now.Add(-1 * time.Hour), End: now.Add(2 * time.Hour)},
+		DiscountType:    "flat",
+		DiscountValue:   50_00,
+		DiscountTarget:  "total_order_value",
+	}
+	assert.Equal(t, nil, test.Service.CreateCoupon(context.Background(), c))
+
+	codeOf := func(err error) (string, service.ErrorKind) {
+		var domainErr *service.Error
+		if !errors.As(err, &domainErr) {
+			return "", 0
+		}
+		return domainErr.Code, domainErr.Kind
+	}
+
+	code, kind := codeOf(test.Service.CreateCoupon(context.Background(), c))
+	assert.Equal(t, "COUPON_EXISTS", code)
+	assert.Equal(t, service.KindConflict, kind)
+
+	bad := *c
+	bad.CouponCode = "BADPCT"
+	bad.DiscountType = "percentage"
+	bad.DiscountValue = 150_00
+	code, kind = codeOf(test.Service.CreateCoupon(context.Background(), &bad))
+	assert.Equal(t, "INVALID_COUPON", code)
+	assert.Equal(t, service.KindInvalid, kind)
+
+	req := models.ValidateCouponRequest{
+		UserID:     "codes-user",
+		CouponCode: "CODES",
+		OrderTotal: 200_00,
+		Timestamp:  now,
+		CartItems:  []models.CartItem{{ID: "med1", Category: "wellness", Price: 200_00}},
+	}
+	_, err := test.Service.ValidateCoupon(context.Background(), req)
+	code, kind = codeOf(err)
+	assert.Equal(t, "MIN_ORDER_NOT_MET", code)
+	assert.Equal(t, service.KindRejected, kind)
+
+	req.CouponCode = "NOSUCHCODE"
+	_, err = test.Service.ValidateCoupon(context.Background(), req)
+	code, kind = codeOf(err)
+	assert.Equal(t, "COUPON_NOT_FOUND", code)
+	assert.Equal(t, service.KindNotFound, kind)
+
+	// Serialization failures are surfaced as retryable conflicts.
+	assert.Equal(t, true, repository.IsSerializationFailure(fmt.Errorf("commit: %w", &pq.Error{Code: "40001"})))
+	assert.Equal(t, false, repository.IsSerializationFailure(&pq.Error{Code: "23505"}))
+	code, kind = codeOf(service.ErrConcurrentUpdate)
+	assert.Equal(t, "CONCURRENT_UPDATE", code)
+	assert.Equal(t, service.KindConflict, kind)
 }